@@ -2,8 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"expvar"
 	"fmt"
+	"math"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,94 +17,714 @@ import (
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
 // BankCase is for concurrent balance transfer.
 type BankCase struct {
-	mu      sync.RWMutex
-	cfg     *Config
+	mu  sync.RWMutex
+	cfg *Config
+	// wg tracks the goroutines running transfers and verifies
 	wg      sync.WaitGroup
 	stopped int32
+	// ready is set once the tables are initialized and verified
+	ready int32
+	// stmts are the transfer statements of each accounts table
+	stmts []*transferStmts
+	// workers are the transfer workers without delay
+	workers transferWorkers
+	// recordCh buffers the records of the committed transfers for
+	// flushRecords, it's only set in Execute if RecordAsync is set
+	recordCh chan []interface{}
+	// err is the first error which stops the bank case, it's protected by mu
+	err error
+	// statusServer is set by StartStatusServer, it's protected by mu
+	statusServer *http.Server
+	// lastWriteTSO is the latest tso of the committed transfers on TiDB
+	lastWriteTSO uint64
+	// warmedUp is set once the warmup ends, the metrics are only recorded after it
+	warmedUp int32
+	// measureStart and measureEnd are the end of the warmup and the end of
+	// the transfers, they're protected by mu
+	measureStart, measureEnd time.Time
+	// txnLimiter limits the rate of the transfers of all workers
+	txnLimiter *rate.Limiter
+	// stopCh is closed when the bank case stops
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// verifyDB is the db of StartVerify, which may be a replica
+	verifyDB *sql.DB
+	// verifyLog is set by OpenVerifyLog if VerifyLog is set
+	verifyLog *verifyLog
+	// lostUpdate is the replay of the records kept by verifyLostUpdate
+	lostUpdate lostUpdateReplay
+	// debugVerifyMu serializes the transfers and their verifies for DebugVerifyEach
+	debugVerifyMu sync.Mutex
+	// resumeCh is closed on resume, it's nil unless the workload is paused
+	pauseMu  sync.Mutex
+	resumeCh chan struct{}
+}
+
+// Actions on invariant violations.
+const (
+	// OnMismatchFatal stops the bank case and exits
+	OnMismatchFatal = "fatal"
+	// OnMismatchPause stops the bank case, dumps the accounts tables and keeps
+	// the process alive for inspection until it's signalled to exit
+	OnMismatchPause = "pause"
+	// OnMismatchContinue logs the violations and keeps running, the first one
+	// is returned at the end
+	OnMismatchContinue = "continue"
+)
+
+// ErrInvariantViolation is the cause of the error Execute returns if the bank
+// case stops because the data violates the invariants, such as a balance mismatch.
+var ErrInvariantViolation = errors.New("invariant violated")
+
+// invariantViolation returns an error whose cause is ErrInvariantViolation.
+func invariantViolation(format string, args ...interface{}) error {
+	return errors.Wrapf(nil, ErrInvariantViolation, format, args...)
 }
 
 // Config is config for bank test
 type Config struct {
-	// NumAccounts is total accounts
-	NumAccounts   int           `toml:"num_accounts"`
+	// NumAccounts is the number of accounts of each table
+	NumAccounts   []int         `toml:"num_accounts"`
 	Interval      time.Duration `toml:"interval"`
 	TableNum      int           `toml:"table_num"`
 	Concurrency   int           `toml:"concurrency"`
 	EnableLongTxn bool          `toml:"enable_long_txn"`
+	// VerifyTimeout is how long verify failures are tolerated before exiting
+	VerifyTimeout time.Duration `toml:"verify_timeout"`
+	// MinDelay and MaxDelay bound the delay of long-term transactions
+	MinDelay time.Duration `toml:"min_delay"`
+	MaxDelay time.Duration `toml:"max_delay"`
+	// Prepared makes transfers use prepared statements
+	Prepared bool `toml:"prepared"`
+	// EnableSavepoint runs transfers which roll back to a savepoint
+	EnableSavepoint bool `toml:"enable_savepoint"`
+	// VerifyMode is VerifyFullSum or VerifyRangeSample
+	VerifyMode string `toml:"verify_mode"`
+	// VerifySampleSize is the number of accounts sampled in range-sample mode
+	VerifySampleSize int `toml:"verify_sample_size"`
+	// TrackUpdatedAt stores the tso of the last transfer in the updated_at column
+	TrackUpdatedAt bool `toml:"track_updated_at"`
+	// PessimisticRatio is the ratio of workers running pessimistic transactions,
+	// the others run optimistic ones. All workers use the global txn mode if it's negative.
+	PessimisticRatio float64 `toml:"pessimistic_ratio"`
+	// AmountMin and AmountMax bound the amount of transfers
+	AmountMin int `toml:"amount_min"`
+	AmountMax int `toml:"amount_max"`
+	// AmountDist is the distribution of amounts, AmountUniform or AmountNormal
+	AmountDist string `toml:"amount_dist"`
+	// RetryLimit is the retry count of inserts and transfers, unlimited if negative
+	RetryLimit int `toml:"retry_limit"`
+	// Seed makes the random transfers reproducible, the current time is used if it's 0
+	Seed int64 `toml:"seed"`
+	// VerifyConcurrency is the number of verify loops, each reads its own snapshot
+	VerifyConcurrency int `toml:"verify_concurrency"`
+	// VerifyRate is the max verify rounds per second of all verify loops, unlimited if 0
+	VerifyRate float64 `toml:"verify_rate"`
+	// WithIndex adds the secondary index idx_balance and verifies it's consistent with the rows
+	WithIndex bool `toml:"with_index"`
+	// GeneratedColumn adds the stored generated column balance_category and an index on it
+	GeneratedColumn bool `toml:"generated_column"`
+	// UnsignedBalance makes balance a BIGINT UNSIGNED column
+	UnsignedBalance bool `toml:"unsigned_balance"`
+	// InitialBalance is the balance of every account after initialization
+	InitialBalance uint64 `toml:"initial_balance"`
+	// ChaosKillConnRatio is the ratio of transfers whose connections are killed before commit
+	ChaosKillConnRatio float64 `toml:"chaos_kill_conn_ratio"`
+	// InitConcurrency is the number of workers inserting the accounts, Concurrency is used if it's not positive
+	InitConcurrency int `toml:"init_concurrency"`
+	// AccountsDDL is the template of the DDL creating the accounts tables
+	// instead of the default one, {{.Table}} is the name of the table.
+	// The existing tables only need to have the columns of accountsDDLColumns.
+	AccountsDDL string `toml:"accounts_ddl"`
+	// AnalyzeAfterInit analyzes the tables after init, so the statistics
+	// are fresh for the transfers and the verifies
+	AnalyzeAfterInit bool `toml:"analyze_after_init"`
+	// InitLogEvery logs every InitLogEvery batches inserted during init,
+	// disabled if 0
+	InitLogEvery int `toml:"init_log_every"`
+	// InitProgressInterval is the interval to log how many accounts are
+	// inserted during init, disabled if 0
+	InitProgressInterval time.Duration `toml:"init_progress_interval"`
+	// VerifyDistinct checks no account id is duplicated in verify
+	VerifyDistinct bool `toml:"verify_distinct"`
+	// RecordRetention is the number of the latest rows kept in the record table, all rows are kept if 0
+	RecordRetention int `toml:"record_retention"`
+	// DisableRecord skips the record table, transfers don't insert into it
+	DisableRecord bool `toml:"disable_record"`
+	// FailFast stops on the first verify error instead of tolerating errors for VerifyTimeout.
+	// The delayed snapshots of long-term transactions may fail transiently, so it may false-positive.
+	FailFast bool `toml:"fail_fast"`
+	// TablePrefix is the prefix of the names of the tables
+	TablePrefix string `toml:"table_prefix"`
+	// Warmup is how long the transfers run before the metrics are recorded
+	Warmup time.Duration `toml:"warmup"`
+	// InitMethod is how the accounts are inserted, InitInsert or InitLoadData
+	InitMethod string `toml:"init_method"`
+	// InitUpsert resets the balances of the existing accounts to InitialBalance
+	// during init, which are kept by INSERT IGNORE otherwise
+	InitUpsert bool `toml:"init_upsert"`
+	// NoDrop refuses to drop the tables whose accounts mismatch NumAccounts
+	// during init, they're repaired in place if InitUpsert is set
+	NoDrop bool `toml:"no_drop"`
+	// MicroVerifyEvery makes every worker re-read the accounts of every MicroVerifyEvery-th
+	// transfer before commit, disabled if 0
+	MicroVerifyEvery int `toml:"micro_verify_every"`
+	// ReconcileTables is the policy of the accounts tables beyond TableNum,
+	// ReconcileWarn, ReconcileVerify or ReconcileDrop
+	ReconcileTables string `toml:"reconcile_tables"`
+	// ChaosDDLOps are the DDL operations, ChaosDDLColumn or ChaosDDLIndex, run
+	// every ChaosDDLInterval during transfers, disabled if empty
+	ChaosDDLOps      []string      `toml:"chaos_ddl_ops"`
+	ChaosDDLInterval time.Duration `toml:"chaos_ddl_interval"`
+	// PostRunVerifyWindow is how long verify keeps running after the transfers
+	// end, the last verify must pass. Disabled if 0.
+	PostRunVerifyWindow time.Duration `toml:"post_run_verify_window"`
+	// VerifyOnStartOnly verifies the tables before and after the transfers instead of during them
+	VerifyOnStartOnly bool `toml:"verify_on_start_only"`
+	// VerifyLostUpdate replays the record table to check no transfer reads a stale balance
+	VerifyLostUpdate bool `toml:"verify_lost_update"`
+	// VerifyTSOOrder replays the record table in tso order to check the balances
+	// of every account progress in the tso order, it only works on TiDB
+	VerifyTSOOrder bool `toml:"verify_tso_order"`
+	// ReadRatio is the ratio of the operations of the workers which are read-only queries instead of transfers
+	ReadRatio float64 `toml:"read_ratio"`
+	// RateLimit is the max transfers per second of all workers, unlimited if 0
+	RateLimit float64 `toml:"rate_limit"`
+	// ReportFile is the file to write the JSON summary of the run to, disabled if empty
+	ReportFile string `toml:"report_file"`
+	// VerifyLog is the csv file to append the sums of every verify to, disabled if empty
+	VerifyLog string `toml:"verify_log"`
+	// StateSnapshotInterval is the interval to snapshot the balances of all
+	// accounts to StateSnapshotDir, disabled if 0. It needs a single table of at
+	// most maxSnapshotAccounts accounts.
+	StateSnapshotInterval time.Duration `toml:"state_snapshot_interval"`
+	StateSnapshotDir      string        `toml:"state_snapshot_dir"`
+	// TableCharset and TableCollation are the charset and collation of the
+	// accounts tables, the server default is used if empty
+	TableCharset   string `toml:"table_charset"`
+	TableCollation string `toml:"table_collation"`
+	// MultibyteRemark fills the remarks with multi-byte UTF-8 characters derived
+	// from the ids, and verify checks the sampled remarks round-trip
+	MultibyteRemark bool `toml:"multibyte_remark"`
+	// LockMode is the lock clause of the select of transfers, LockForUpdate or LockForUpdateNowait
+	LockMode string `toml:"lock_mode"`
+	// LockOrder is the order to lock the accounts of transfers, LockOrderNone,
+	// LockOrderFromTo or LockOrderAscending
+	LockOrder string `toml:"lock_order"`
+	// LogDeadlock logs the accounts of the transfers which deadlock
+	LogDeadlock bool `toml:"log_deadlock"`
+	// PinConn makes every worker run its transfers on a connection pinned for
+	// its lifetime, so the session variables persist
+	PinConn bool `toml:"pin_conn"`
+	// AccountChurn is the ratio of the operations which close or open an
+	// account instead of transferring, the money of the closed accounts
+	// is kept by the sink account until the accounts are opened again
+	AccountChurn float64 `toml:"account_churn"`
+	// RecordAsync inserts the records in batches after the transfers commit
+	// instead of in the transfer transactions, the record table lags behind
+	RecordAsync bool `toml:"record_async"`
+	// RecordFanout is the number of the record rows every transfer inserts,
+	// distinguished by the seq column, to amplify the writes. One row without
+	// the seq column is inserted if it's at most 1.
+	RecordFanout int `toml:"record_fanout"`
+	// StaleRead verifies the balances as of StaleRead ago by the stale read of
+	// TiDB, disabled if 0
+	StaleRead time.Duration `toml:"stale_read"`
+	// WriteSkewPairs is the number of the account pairs of the write skew
+	// test in the write_skew table, disabled if 0
+	WriteSkewPairs int `toml:"write_skew_pairs"`
+	// WriteSkewLock locks the pairs in the withdrawals by LockMode, a write
+	// skew is an invariant violation then, otherwise it's only counted
+	WriteSkewLock bool `toml:"write_skew_lock"`
+	// ClusteredIndex is the clustering of the primary keys of the accounts
+	// tables on TiDB, one of ClusteredIndexDefault, ClusteredIndexOn and ClusteredIndexOff
+	ClusteredIndex string `toml:"clustered_index"`
+	// CompositeKey keys the accounts by (id, shard), the shard is id % accountShards
+	CompositeKey bool `toml:"composite_key"`
+	// IDScheme is how the accounts are numbered, IDSequential or IDBitReversed
+	IDScheme string `toml:"id_scheme"`
+	// VerifyTiFlash compares the sums of the balances on TiFlash and on TiKV
+	// at the same snapshot, the tables without TiFlash replicas are skipped
+	VerifyTiFlash bool `toml:"verify_tiflash"`
+	// VerifyHint is the optimizer hint of the verify sums to force a good
+	// plan, like read_from_storage(tikv[accounts]), disabled if empty
+	VerifyHint string `toml:"verify_hint"`
+	// VerifyRetry is the max number of the retries of a verify failing for a
+	// transient error, the mismatches are never retried
+	VerifyRetry int `toml:"verify_retry"`
+	// ExportSnapshot is the file to export the tso of a snapshot to every
+	// Interval for the other bank processes, disabled if empty
+	ExportSnapshot string `toml:"export_snapshot"`
+	// VerifyAtSnapshot is the file of the tso exported by another bank
+	// process, the balances are verified as of the tso, disabled if empty
+	VerifyAtSnapshot string `toml:"verify_at_snapshot"`
+	// VerifySnapshotStability sums the balances again after it in the verify
+	// transactions, the sums must be the same, disabled if 0
+	VerifySnapshotStability time.Duration `toml:"verify_snapshot_stability"`
+	// TxnSize is the number of the transfers in a transaction, which commits
+	// them at once to build a large write set
+	TxnSize int `toml:"txn_size"`
+	// OnMismatch is the action on invariant violations, OnMismatchFatal,
+	// OnMismatchPause or OnMismatchContinue
+	OnMismatch string `toml:"on_mismatch"`
+	// MaxDrift stops the bank case continuing on mismatches for
+	// OnMismatchContinue once the balances of a table drift by more than it,
+	// disabled if 0
+	MaxDrift int64 `toml:"max_drift"`
+	// DebugVerifyEach verifies the accounts table after every transfer, the
+	// transfers are serialized so a mismatch is caused by the last one. It's
+	// for tiny tables only
+	DebugVerifyEach bool `toml:"debug_verify_each"`
+	// PoolStatsInterval is the interval to log the stats of the connection pools, disabled if 0
+	PoolStatsInterval time.Duration `toml:"pool_stats_interval"`
+	// SlowTxnThreshold is the duration over which a transfer is logged as slow, disabled if 0
+	SlowTxnThreshold time.Duration `toml:"slow_txn_threshold"`
+
+	// The following fields are only used by Run.
+
+	// Mode is the run mode, such as init, run or init+run
+	Mode string `toml:"mode"`
+	// ConnectTimeout is how long to wait for the database to be connectable
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	// Pessimistic sets the global txn mode to pessimistic on TiDB
+	Pessimistic     bool          `toml:"pessimistic"`
+	MaxOpenConns    int           `toml:"max_open_conns"`
+	MaxIdleConns    int           `toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `toml:"conn_max_lifetime"`
+	// ConnLifetimeJitter shortens the lifetime of every connection by a random
+	// duration up to it, so the connections don't expire at once
+	ConnLifetimeJitter time.Duration `toml:"conn_lifetime_jitter"`
+	// KeepaliveInterval is the interval to ping the idle connections, disabled if 0
+	KeepaliveInterval time.Duration `toml:"keepalive_interval"`
+	// Addrs are the tcp addresses the connections round-robin, the DSN
+	// connects its own address if there are less than two
+	Addrs []string `toml:"addrs"`
+	// VerifyAddr is the address of the replica to verify on, the transfers
+	// still run on the primary. The db is verified if empty.
+	VerifyAddr string `toml:"verify_addr"`
+	// StatusAddr is the address of the status server, disabled if empty
+	StatusAddr string `toml:"status_addr"`
+	// ControlAddr is the address of the control server, which changes the
+	// concurrency at run time, disabled if empty
+	ControlAddr string `toml:"control_addr"`
+	// DumpFile and DumpFormat are the output of dump-records mode
+	DumpFile   string `toml:"dump_file"`
+	DumpFormat string `toml:"dump_format"`
+	// SnapshotDiff are the old and new state snapshot files of snapshot-diff mode
+	SnapshotDiff []string `toml:"snapshot_diff"`
 }
 
+// Amount distributions.
+const (
+	AmountUniform = "uniform"
+	AmountNormal  = "normal"
+)
+
+// TiDB txn modes.
+const (
+	txnModeOptimistic  = "optimistic"
+	txnModePessimistic = "pessimistic"
+)
+
+// Verify modes.
+const (
+	// VerifyFullSum sums the balances of all accounts
+	VerifyFullSum = "full-sum"
+	// VerifyRangeSample sums a random range of accounts and checks it against the record table
+	VerifyRangeSample = "range-sample"
+)
+
 // NewBankCase returns the BankCase.
 func NewBankCase(cfg *Config) *BankCase {
 	b := &BankCase{
-		cfg: cfg,
+		cfg:    cfg,
+		stopCh: make(chan struct{}),
+	}
+	limit := rate.Inf
+	if cfg.RateLimit > 0 {
+		limit = rate.Limit(cfg.RateLimit)
 	}
+	b.txnLimiter = rate.NewLimiter(limit, 1)
 	if b.cfg.TableNum <= 1 {
 		b.cfg.TableNum = 1
 	}
+	// a single number is shared by all tables
+	if len(b.cfg.NumAccounts) == 1 {
+		for len(b.cfg.NumAccounts) < b.cfg.TableNum {
+			b.cfg.NumAccounts = append(b.cfg.NumAccounts, b.cfg.NumAccounts[0])
+		}
+	}
+	for i := 0; i < b.cfg.TableNum; i++ {
+		b.stmts = append(b.stmts, newTransferStmts(b.accountsTable(tableIndex(i)), b.recordTable(), b.cfg.TrackUpdatedAt, b.cfg.LockMode, b.cfg.RecordFanout, b.cfg.CompositeKey))
+	}
 	return b
 }
 
+// OpenVerifyLog opens VerifyLog to append the sums of the verifies to, it's
+// closed by Close.
+func (c *BankCase) OpenVerifyLog() error {
+	l, err := openVerifyLog(c.cfg.VerifyLog)
+	if err != nil {
+		return errors.Annotate(err, "open verify log")
+	}
+	c.verifyLog = l
+	return nil
+}
+
 // Initialize implements Case Initialize interface.
 func (c *BankCase) Initialize(ctx context.Context, db *sql.DB) error {
 	log.Infof("[%s] start to init...", c)
 	defer func() {
 		log.Infof("[%s] init end...", c)
 	}()
+	// reinit is whether any accounts table is initialized, reinitAll is
+	// whether all of them are
+	var (
+		reinit    bool
+		reinitAll = true
+		start     = time.Now()
+		accounts  int
+		tables    []string
+	)
 	for i := 0; i < c.cfg.TableNum; i++ {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
-		err := c.initDB(ctx, db, i)
+		tableStart := time.Now()
+		initialized, err := c.initDB(ctx, db, i)
 		if err != nil {
 			return err
 		}
+		if initialized {
+			table, took := c.accountsTable(tableIndex(i)), time.Since(tableStart)
+			initAccounts.Add(table, int64(c.cfg.NumAccounts[i]))
+			initSeconds.AddFloat(table, took.Seconds())
+			accounts += c.cfg.NumAccounts[i]
+			tables = append(tables, fmt.Sprintf("%s: %d in %s", table, c.cfg.NumAccounts[i], took))
+		}
+		reinit = reinit || initialized
+		reinitAll = reinitAll && initialized
+	}
+	if reinit && !reinitAll && !c.cfg.DisableRecord {
+		log.Warnf("[%s] keep the records of the reused accounts tables, the records of the re-initialized ones are stale", c)
+	}
+	if err := c.initRecordTable(ctx, db, reinitAll); err != nil {
+		return err
+	}
+	if took := time.Since(start); reinit {
+		log.Infof("[%s] init %d accounts in %s, %.0f accounts/s, %s", c, accounts, took, float64(accounts)/took.Seconds(), strings.Join(tables, ", "))
+	}
+	if c.cfg.AnalyzeAfterInit {
+		c.analyzeTables(ctx, db)
 	}
 	return nil
 }
 
-func (c *BankCase) initDB(ctx context.Context, db *sql.DB, id int) error {
-	var index string
-	if id > 0 {
-		index = fmt.Sprintf("%d", id)
+// StartVerify verifies all the tables once, then keeps verifying them in background.
+func (c *BankCase) StartVerify(ctx context.Context, db *sql.DB) {
+	// the verify after the transfers uses db too
+	c.verifyDB = db
+	c.verifyAll(ctx, db, "initial", 0)
+	atomic.StoreInt32(&c.ready, 1)
+	if c.cfg.VerifyOnStartOnly {
+		// Execute verifies again after the transfers end
+		return
 	}
-	isDropped := c.tryDrop(db, index)
-	if !isDropped {
-		c.startVerify(ctx, db, index)
-		return nil
+
+	limit := rate.Inf
+	if c.cfg.VerifyRate > 0 {
+		limit = rate.Limit(c.cfg.VerifyRate)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+
+	run := func(stagger time.Duration, f func()) {
+		defer c.wg.Done()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stagger):
+		}
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.stopCh:
+				return
+			case <-ticker.C:
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+				f()
+			}
+		}
+	}
+
+	// lastSuccess is the UnixNano of the last time any verifier succeeded,
+	// the verifiers share the verify timeout.
+	lastSuccess := time.Now().UnixNano()
+	verifiers := c.cfg.VerifyConcurrency
+	if verifiers <= 0 {
+		verifiers = 1
+	}
+	for i := 0; i < verifiers; i++ {
+		name := fmt.Sprintf("verifier %d", i)
+		c.wg.Add(1)
+		go run(c.cfg.Interval*time.Duration(i)/time.Duration(verifiers), func() {
+			err := c.verifyAll(ctx, db, name, 0)
+			if err != nil && ctx.Err() != nil {
+				// canceled on shutdown
+				return
+			}
+			if err != nil {
+				start := time.Unix(0, atomic.LoadInt64(&lastSuccess))
+				log.Infof("[%s] %s verify error: %s in: %s", c, name, err, time.Now())
+				if c.cfg.FailFast {
+					log.Infof("[%s] stop bank execute for fail-fast", c)
+					c.stop(errors.Annotate(err, "verify"))
+				} else if time.Now().Sub(start) > c.cfg.VerifyTimeout {
+					log.Infof("[%s] stop bank execute", c)
+					c.stop(errors.Annotatef(err, "verify timeout since %s", start))
+				}
+			} else {
+				atomic.StoreInt64(&lastSuccess, time.Now().UnixNano())
+				log.Infof("[%s] %s verify success in %s", c, name, time.Now())
+			}
+		})
+	}
+
+	if c.cfg.EnableLongTxn {
+		rng := c.newRand(-1)
+		c.wg.Add(1)
+		go run(0, func() { c.verifyAll(ctx, db, "long-txn verifier", c.delayDuration(rng)) })
+	}
+	if c.cfg.StaleRead > 0 {
+		since := time.Now()
+		c.wg.Add(1)
+		go run(0, func() { c.verifyStaleRead(ctx, db, since) })
+	}
+	if c.cfg.VerifyTiFlash {
+		c.wg.Add(1)
+		go run(0, func() { c.verifyTiFlash(ctx, db) })
+	}
+	if c.cfg.ExportSnapshot != "" {
+		c.wg.Add(1)
+		go run(0, func() { c.exportSnapshot(ctx, db) })
+	}
+	if c.cfg.VerifyAtSnapshot != "" {
+		c.wg.Add(1)
+		go run(0, func() {
+			if err := c.verifyAtSnapshot(ctx, db); err != nil && ctx.Err() == nil {
+				log.Errorf("[%s] %v", c, err)
+			}
+		})
+	}
+}
+
+// VerifyOnce verifies all the tables once.
+func (c *BankCase) VerifyOnce(ctx context.Context, db *sql.DB) error {
+	if err := c.verifyAll(ctx, db, "verify-once", 0); err != nil {
+		return err
+	}
+	if c.cfg.VerifyAtSnapshot != "" {
+		return c.verifyAtSnapshot(ctx, db)
+	}
+	return nil
+}
+
+// verifyAll verifies all the tables concurrently and logs their results in one
+// line. It stops the bank case naming the failed tables if any table mismatches,
+// otherwise it returns the first error of the tables which fail to verify.
+func (c *BankCase) verifyAll(ctx context.Context, db *sql.DB, verifier string, delay time.Duration) error {
+	errs := make([]error, c.cfg.TableNum)
+	var wg sync.WaitGroup
+	for i := 0; i < c.cfg.TableNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.verifyWithRetry(ctx, db, verifier, i, delay)
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		results    []string
+		mismatches []string
+		firstErr   error
+	)
+	for i, err := range errs {
+		table := c.accountsTable(tableIndex(i))
+		switch {
+		case err == nil:
+			results = append(results, table+": ok")
+		case isMismatch(err):
+			results = append(results, table+": mismatch")
+			mismatches = append(mismatches, err.Error())
+		default:
+			results = append(results, table+": error")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	log.Infof("[%s] %s verify %d tables, %s", c, verifier, c.cfg.TableNum, strings.Join(results, ", "))
+
+	if len(mismatches) > 0 {
+		err := invariantViolation("verify failed: %s", strings.Join(mismatches, "; "))
+		c.stop(err)
+		return err
+	}
+	return firstErr
+}
+
+// Cleanup drops all the accounts tables, the record table and the write skew table, the tables
+// which don't exist are skipped.
+func (c *BankCase) Cleanup(ctx context.Context, db *sql.DB) error {
+	tables := []string{c.recordTable(), c.writeSkewTable()}
+	for i := 0; i < c.cfg.TableNum; i++ {
+		tables = append(tables, c.accountsTable(tableIndex(i)))
+	}
+	for _, table := range tables {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("drop table if exists %s", table)); err != nil {
+			return errors.Annotatef(err, "drop table %s", table)
+		}
+		log.Infof("[%s] drop table %s", c, table)
 	}
+	return nil
+}
 
-	MustExec(db, fmt.Sprintf("create table if not exists accounts%s (id BIGINT PRIMARY KEY, balance BIGINT NOT NULL, remark VARCHAR(128))", index))
-	MustExec(db, `create table if not exists record (id BIGINT AUTO_INCREMENT,
+// initRecordTable creates the record table shared by all accounts tables once.
+// It's only dropped first if every accounts table is re-initialized by
+// reinitAll, unless for NoDrop, the records of the reused tables are kept.
+func (c *BankCase) initRecordTable(ctx context.Context, db *sql.DB, reinitAll bool) error {
+	if c.cfg.DisableRecord {
+		return nil
+	}
+	if reinitAll && !c.cfg.NoDrop {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", c.recordTable())); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	var seqColumn string
+	if c.cfg.RecordFanout > 1 {
+		seqColumn = "seq INT NOT NULL DEFAULT 0,"
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %[2]s (id BIGINT AUTO_INCREMENT,
         from_id BIGINT NOT NULL,
         to_id BIGINT NOT NULL,
-        from_balance BIGINT NOT NULL,
-        to_balance BIGINT NOT NULL,
+        from_balance %[1]s NOT NULL,
+        to_balance %[1]s NOT NULL,
         amount BIGINT NOT NULL,
-        tso BIGINT UNSIGNED NOT NULL,
-        PRIMARY KEY(id))`)
-	var wg sync.WaitGroup
+        tso BIGINT UNSIGNED NOT NULL,%[3]s
+        PRIMARY KEY(id))`, c.balanceType(), c.recordTable(), seqColumn)); err != nil {
+		return errors.Trace(err)
+	}
+	// the record table may be left by an earlier run
+	return c.checkRecordSchema(ctx, db)
+}
+
+// balanceType returns the column type of the balances.
+func (c *BankCase) balanceType() string {
+	if c.cfg.UnsignedBalance {
+		return "BIGINT UNSIGNED"
+	}
+	return "BIGINT"
+}
+
+// initDB initializes the id-th accounts table, it returns whether the accounts
+// are initialized, or the existing ones are reused.
+func (c *BankCase) initDB(ctx context.Context, db *sql.DB, id int) (bool, error) {
+	index := tableIndex(id)
+	numAccounts := c.cfg.NumAccounts[id]
+	isDropped, err := c.tryDrop(ctx, db, index, numAccounts)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !isDropped {
+		// the existing data is reused, it must match the schema
+		return false, c.checkAccountsSchema(ctx, db, index)
+	}
+
+	balanceType := c.balanceType()
+	var extraColumns string
+	if c.cfg.TrackUpdatedAt {
+		extraColumns += ", updated_at BIGINT UNSIGNED NOT NULL DEFAULT 0"
+	}
+	if c.cfg.WithIndex {
+		extraColumns += ", KEY idx_balance (balance)"
+	}
+	if c.cfg.GeneratedColumn {
+		extraColumns += ", balance_category BIGINT AS (balance DIV 1000) STORED, KEY idx_balance_category (balance_category)"
+	}
+	var tableOptions string
+	if c.cfg.TableCharset != "" {
+		tableOptions += " DEFAULT CHARSET=" + c.cfg.TableCharset
+	}
+	if c.cfg.TableCollation != "" {
+		tableOptions += " COLLATE=" + c.cfg.TableCollation
+	}
+	primaryKey := "id BIGINT PRIMARY KEY" + clusteredClauses[c.cfg.ClusteredIndex]
+	if c.cfg.CompositeKey {
+		primaryKey = fmt.Sprintf("id BIGINT NOT NULL, shard BIGINT NOT NULL, PRIMARY KEY(id, shard)%s", clusteredClauses[c.cfg.ClusteredIndex])
+	}
+	ddl := fmt.Sprintf("create table if not exists %s (%s, balance %s NOT NULL, remark VARCHAR(128)%s)%s", c.accountsTable(index), primaryKey, balanceType, extraColumns, tableOptions)
+	if c.cfg.AccountsDDL != "" {
+		if ddl, err = c.accountsDDL(index); err != nil {
+			return true, errors.Trace(err)
+		}
+	}
+	if _, err = db.Exec(ddl); err != nil {
+		return true, errors.Trace(err)
+	}
+
+	if c.cfg.InitMethod == InitLoadData {
+		err = c.loadAccounts(ctx, db, index, numAccounts)
+		if err == nil {
+			return true, nil
+		}
+		// the accounts loaded are ignored by the INSERT IGNORE
+		log.Warnf("[%s] load data error %v, fall back to insert", c, err)
+	}
+
+	// the first failed insert cancels the others
+	insertCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg        sync.WaitGroup
+		insertErr error
+		errOnce   sync.Once
+	)
 
 	// TODO: fix the error is NumAccounts can't be divided by batchSize.
 	// Insert batchSize values in one SQL.
 	batchSize := 100
-	jobCount := c.cfg.NumAccounts / batchSize
+	jobCount := numAccounts / batchSize
+
+	initConcurrency := c.cfg.InitConcurrency
+	if initConcurrency <= 0 {
+		initConcurrency = c.cfg.Concurrency
+	}
+
+	progress := c.startInitProgress(c.accountsTable(index), jobCount*batchSize)
+	defer progress.stop()
 
-	maxLen := len(remark)
 	ch := make(chan int, jobCount)
-	for i := 0; i < c.cfg.Concurrency; i++ {
+	for i := 0; i < initConcurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			args := make([]string, batchSize)
 			for {
 				select {
-				case <-ctx.Done():
+				case <-insertCtx.Done():
 					return
 				default:
 				}
@@ -109,10 +734,14 @@ func (c *BankCase) initDB(ctx context.Context, db *sql.DB, id int) error {
 				}
 				start := time.Now()
 				for i := 0; i < batchSize; i++ {
-					args[i] = fmt.Sprintf("(%d, %d, \"%s\")", startIndex+i, 1000, remark[:rand.Intn(maxLen)])
+					id := c.accountID(startIndex + i)
+					args[i] = c.accountValues(id, c.cfg.InitialBalance, c.accountRemark(id))
 				}
 
-				query := fmt.Sprintf("INSERT IGNORE INTO accounts%s (id, balance, remark) VALUES %s", index, strings.Join(args, ","))
+				query := fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES %s", c.accountsTable(index), c.insertColumns(), strings.Join(args, ","))
+				if c.cfg.InitUpsert {
+					query = fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE balance = VALUES(balance)", c.accountsTable(index), c.insertColumns(), strings.Join(args, ","))
+				}
 				insertF := func() error {
 					_, err := db.Exec(query)
 					if IsErrDupEntry(err) {
@@ -120,11 +749,19 @@ func (c *BankCase) initDB(ctx context.Context, db *sql.DB, id int) error {
 					}
 					return err
 				}
-				err := RunWithRetry(ctx, *retryLimit, 5*time.Second, insertF)
+				attempts, err := RunWithRetryAttempts(insertCtx, c.cfg.RetryLimit, 5*time.Second, insertF)
 				if err != nil {
-					log.Fatalf("[%s]exec %s  err %s", c, query, err)
+					log.Errorf("[%s]exec %s  err %s", c, query, err)
+					errOnce.Do(func() {
+						insertErr = errors.Annotatef(err, "insert %s", c.accountsTable(index))
+						cancel()
+					})
+					return
+				}
+				insertAttempts.Add(attemptsKey(attempts), 1)
+				if batches := progress.add(batchSize); c.cfg.InitLogEvery > 0 && batches%int64(c.cfg.InitLogEvery) == 0 {
+					log.Infof("[%s] insert %d batches of %d %s, the last takes %s", c, batches, batchSize, c.accountsTable(index), time.Now().Sub(start))
 				}
-				log.Infof("[%s] insert %d accounts%s, takes %s", c, batchSize, index, time.Now().Sub(start))
 			}
 		}()
 	}
@@ -135,54 +772,18 @@ func (c *BankCase) initDB(ctx context.Context, db *sql.DB, id int) error {
 
 	close(ch)
 	wg.Wait()
+	if insertErr != nil {
+		return true, insertErr
+	}
 
 	select {
 	case <-ctx.Done():
 		log.Warn("[%s] bank initialize is cancel", c)
-		return nil
+		return true, nil
 	default:
 	}
 
-	c.startVerify(ctx, db, index)
-	return nil
-}
-
-func (c *BankCase) startVerify(ctx context.Context, db *sql.DB, index string) {
-	c.verify(ctx, db, index, noDelay)
-
-	run := func(f func()) {
-		ticker := time.NewTicker(c.cfg.Interval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				f()
-			}
-		}
-	}
-
-	start := time.Now()
-	go run(func() {
-		err := c.verify(ctx, db, index, noDelay)
-		if err != nil {
-			log.Infof("[%s] verify error: %s in: %s", c, err, time.Now())
-			if time.Now().Sub(start) > defaultVerifyTimeout {
-				atomic.StoreInt32(&c.stopped, 1)
-				log.Infof("[%s] stop bank execute", c)
-				c.wg.Wait()
-				log.Fatalf("[%s] verify timeout since %s, error: %s", c, start, err)
-			}
-		} else {
-			start = time.Now()
-			log.Infof("[%s] verify success in %s", c, time.Now())
-		}
-	})
-
-	if c.cfg.EnableLongTxn {
-		go run(func() { c.verify(ctx, db, index, delayRead) })
-	}
+	return true, nil
 }
 
 // Execute implements Case Execute interface.
@@ -191,146 +792,448 @@ func (c *BankCase) Execute(ctx context.Context, db *sql.DB) error {
 	defer func() {
 		log.Infof("[%s] test end...", c)
 	}()
-	var wg sync.WaitGroup
 
-	run := func(f func()) {
+	if c.cfg.Prepared {
+		for _, stmts := range c.stmts {
+			defer stmts.close()
+			if err := stmts.prepare(ctx, db); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	if c.cfg.RecordAsync {
+		c.recordCh = make(chan []interface{}, recordFlushBatch)
+		flushed := make(chan struct{})
+		go c.flushRecords(db, flushed)
+		// the workers exit before recordCh is closed, all the records
+		// of the committed transfers are flushed
+		defer func() {
+			close(c.recordCh)
+			<-flushed
+		}()
+	}
+
+	// quit is nil for the workers which run until the transfers end, the
+	// others are spawned by SetConcurrency and tracked by workers.wg
+	run := func(delay delayMode, txnMode string, seed int, quit <-chan struct{}) {
+		if txnMode == "" && c.cfg.LockMode == LockNone {
+			// the global txn mode may be pessimistic, which would lose updates
+			// without locking the reads
+			txnMode = txnModeOptimistic
+		}
+		w := &worker{
+			rng:     c.newRand(seed),
+			delay:   delay,
+			txnMode: txnMode,
+		}
+		wg := &c.wg
+		if quit != nil {
+			wg = &c.workers.wg
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer w.unpin()
 			for {
 				select {
 				case <-ctx.Done():
 					return
+				case <-c.stopCh:
+					return
+				case <-quit:
+					return
 				default:
 				}
-				if atomic.LoadInt32(&c.stopped) != 0 {
-					// too many log print in here if return error
-					log.Errorf("[%s] bank stopped", c)
+				if !c.waitResumed(ctx, quit) {
 					return
 				}
-				c.wg.Add(1)
-				f()
-				c.wg.Done()
+				c.recoverPanic(w, func() {
+					if w.delay == noDelay && c.cfg.ReadRatio > 0 && w.rng.Float64() < c.cfg.ReadRatio {
+						c.readAccounts(ctx, db, w)
+						return
+					}
+					if w.delay == noDelay && c.cfg.AccountChurn > 0 && w.rng.Float64() < c.cfg.AccountChurn {
+						c.churnAccount(ctx, db, w)
+						return
+					}
+					c.moveMoney(ctx, db, w)
+				})
 			}
 		}()
 	}
 
-	for i := 0; i < c.cfg.Concurrency; i++ {
-		run(func() { c.moveMoney(ctx, db, noDelay) })
+	// the transfer workers are spawned by SetConcurrency, any number of the
+	// first workers has PessimisticRatio of them in pessimistic txn mode
+	c.workers.mu.Lock()
+	c.workers.spawn = func(i, seed int, quit <-chan struct{}) {
+		var txnMode string
+		if c.cfg.PessimisticRatio >= 0 {
+			txnMode = txnModeOptimistic
+			if pessimisticWorkers(c.cfg.PessimisticRatio, i+1) > pessimisticWorkers(c.cfg.PessimisticRatio, i) {
+				txnMode = txnModePessimistic
+			}
+		}
+		run(noDelay, txnMode, seed, quit)
+	}
+	c.workers.mu.Unlock()
+	if err := c.SetConcurrency(c.cfg.Concurrency); err != nil {
+		return errors.Trace(err)
 	}
 	if c.cfg.EnableLongTxn {
-		run(func() { c.moveMoney(ctx, db, delayRead) })
-		run(func() { c.moveMoney(ctx, db, delayCommit) })
+		run(delayRead, "", c.workers.nextSeed(), nil)
+		run(delayCommit, "", c.workers.nextSeed(), nil)
+	}
+	if c.cfg.EnableSavepoint {
+		run(savepointMode, "", c.workers.nextSeed(), nil)
 	}
 
-	wg.Wait()
-	return nil
-}
-
-// String implements fmt.Stringer interface.
-func (c *BankCase) String() string {
-	return "bank"
-}
+	if c.cfg.WriteSkewPairs > 0 {
+		if err := c.initWriteSkew(ctx, db); err != nil {
+			return errors.Annotate(err, "init write skew")
+		}
+		for pair := 0; pair < c.cfg.WriteSkewPairs; pair++ {
+			for side := 0; side < 2; side++ {
+				c.wg.Add(1)
+				go c.writeSkew(ctx, db, pair, side, c.newRand(c.workers.nextSeed()))
+			}
+		}
+	}
+	if c.cfg.RecordRetention > 0 {
+		c.wg.Add(1)
+		go c.pruneRecords(ctx, db)
+	}
+	if len(c.cfg.ChaosDDLOps) > 0 {
+		c.wg.Add(1)
+		go c.chaosDDL(ctx, db)
+	}
+	if c.cfg.StateSnapshotInterval > 0 {
+		c.wg.Add(1)
+		go c.snapshotStates(ctx, db)
+	}
 
-//tryDrop will drop table if data incorrect and panic error likes Bad connect.
-func (c *BankCase) tryDrop(db *sql.DB, index string) bool {
-	var (
-		count int
-		table string
-	)
-	//if table is not exist ,return true directly
-	query := fmt.Sprintf("show tables like 'accounts%s'", index)
-	err := db.QueryRow(query).Scan(&table)
-	switch {
-	case err == sql.ErrNoRows:
-		return true
-	case err != nil:
-		log.Fatalf("[%s] execute query %s error %v", c, query, err)
+	done := make(chan struct{})
+	defer close(done)
+	if c.cfg.Warmup > 0 {
+		log.Infof("[%s] warm up for %s", c, c.cfg.Warmup)
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-done:
+			case <-time.After(c.cfg.Warmup):
+				log.Infof("[%s] warmup ends, start to record metrics", c)
+				c.endWarmup()
+			}
+		}()
+	} else {
+		c.endWarmup()
+	}
+	go func() {
+		ticker := time.NewTicker(defaultPushMetricsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				logMetrics(c)
+			}
+		}
+	}()
+	if c.cfg.PoolStatsInterval > 0 {
+		go c.logPoolStats(ctx, db, done)
 	}
 
-	query = fmt.Sprintf("select count(*) as count from accounts%s", index)
-	err = db.QueryRow(query).Scan(&count)
-	if err != nil {
-		log.Fatalf("[%s] execute query %s error %v", c, query, err)
+	// the transfers end once ctx is done or the bank case stops, then
+	// SetConcurrency can't spawn any worker before the workers are waited.
+	// The verify goroutines exit when the transfers do, no goroutine touches
+	// the database after Execute returns
+	select {
+	case <-ctx.Done():
+	case <-c.stopCh:
+	}
+	c.workers.mu.Lock()
+	c.workers.spawn, c.workers.quits = nil, nil
+	c.workers.mu.Unlock()
+	c.workers.wg.Wait()
+	c.wg.Wait()
+	c.mu.Lock()
+	c.measureEnd = time.Now()
+	c.mu.Unlock()
+	if c.verifyDB != nil {
+		db = c.verifyDB
 	}
-	if count == c.cfg.NumAccounts {
-		return false
+	if atomic.LoadInt32(&c.stopped) != 0 {
+		log.Errorf("[%s] bank stopped", c)
+	} else if c.cfg.PostRunVerifyWindow > 0 {
+		c.postRunVerify(db)
+	} else if c.cfg.VerifyOnStartOnly {
+		// ctx is done, verify the end state with a new one
+		verifyCtx, cancel := context.WithTimeout(context.Background(), finalVerifyTimeout)
+		c.verifyAll(verifyCtx, db, "final", 0)
+		cancel()
 	}
 
-	log.Infof("[%s] we need %d accounts%s but got %d, re-initialize the data again", c, c.cfg.NumAccounts, index, count)
-	MustExec(db, fmt.Sprintf("drop table if exists accounts%s", index))
-	MustExec(db, "DROP TABLE IF EXISTS record")
-	return true
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
 }
 
-func (c *BankCase) verify(ctx context.Context, db *sql.DB, index string, delay delayMode) error {
-	var total int
-
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Trace(err)
-	}
+// endWarmup starts to record the metrics and measure the transfers.
+func (c *BankCase) endWarmup() {
+	c.mu.Lock()
+	c.measureStart = time.Now()
+	c.mu.Unlock()
+	atomic.StoreInt32(&c.warmedUp, 1)
+}
 
-	defer tx.Rollback()
+// finalVerifyTimeout is the timeout of the verify after the transfers end.
+const finalVerifyTimeout = 10 * time.Minute
 
-	if delay == delayRead {
-		err = c.delay(ctx)
-		if err != nil {
-			return err
+// postRunVerify keeps verifying every Interval for PostRunVerifyWindow after
+// the transfers end, the state may take a while to converge on multi-replica
+// setups. The errors are tolerated in the window but the last verify must pass.
+func (c *BankCase) postRunVerify(db *sql.DB) {
+	log.Infof("[%s] transfers end, verify for %s", c, c.cfg.PostRunVerifyWindow)
+	deadline := time.Now().Add(c.cfg.PostRunVerifyWindow)
+	for {
+		verifyCtx, cancel := context.WithTimeout(context.Background(), finalVerifyTimeout)
+		err := c.verifyAll(verifyCtx, db, "post-run", 0)
+		cancel()
+		if atomic.LoadInt32(&c.stopped) != 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				c.stop(errors.Annotatef(err, "post-run verify in %s", c.cfg.PostRunVerifyWindow))
+			}
+			return
 		}
+		time.Sleep(c.cfg.Interval)
 	}
+}
 
-	query := fmt.Sprintf("select sum(balance) as total from accounts%s", index)
-	err = tx.QueryRow(query).Scan(&total)
-	if err != nil {
-		log.Errorf("[%s] select sum error %v", c, err)
-		return errors.Trace(err)
+// stop stops the transfers for err, the first err is returned by Execute.
+func (c *BankCase) stop(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
 	}
-	if TiDBDatabase {
-		var tso uint64
-		if err = tx.QueryRow("select @@tidb_current_ts").Scan(&tso); err != nil {
-			return errors.Trace(err)
-		}
-		log.Infof("[%s] select sum(balance) to verify use tso %d", c, tso)
+	c.mu.Unlock()
+	// Execute still returns the first violation at the end
+	if c.cfg.OnMismatch == OnMismatchContinue && errors.Cause(err) == ErrInvariantViolation {
+		log.Errorf("[%s] %v, continue for on-mismatch %s", c, err, OnMismatchContinue)
+		invariantViolations.Add(1)
+		return
 	}
-	tx.Commit()
-	check := c.cfg.NumAccounts * 1000
-	if total != check {
-		log.Errorf("[%s] accouts%s total must %d, but got %d", c, index, check, total)
+	log.Errorf("[%s] stop for %v", c, err)
+	c.markStopped()
+}
+
+// markStopped sets stopped and closes stopCh, the goroutines selecting on
+// stopCh exit promptly.
+func (c *BankCase) markStopped() {
+	c.stopOnce.Do(func() {
 		atomic.StoreInt32(&c.stopped, 1)
+		close(c.stopCh)
+	})
+}
+
+// pruneRecordsBatch is the max number of rows pruneRecords deletes in one statement.
+const pruneRecordsBatch = 10000
+
+// pruneRecords deletes the rows of the record table except the latest
+// RecordRetention ones every Interval until the bank case stops.
+func (c *BankCase) pruneRecords(ctx context.Context, db *sql.DB) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		var maxID sql.NullInt64
+		if err := db.QueryRowContext(ctx, fmt.Sprintf("select max(id) from %s", c.recordTable())).Scan(&maxID); err != nil {
+			log.Errorf("[%s] select max record id error %v", c, err)
+			continue
+		}
+		if !maxID.Valid || maxID.Int64 <= int64(c.cfg.RecordRetention) {
+			continue
+		}
+		end := maxID.Int64 - int64(c.cfg.RecordRetention)
+		var pruned int64
+		for {
+			res, err := db.ExecContext(ctx, fmt.Sprintf("delete from %s where id <= ? limit ?", c.recordTable()), end, pruneRecordsBatch)
+			if err != nil {
+				log.Errorf("[%s] prune record error %v", c, err)
+				break
+			}
+			affected, _ := res.RowsAffected()
+			pruned += affected
+			if affected < pruneRecordsBatch {
+				break
+			}
+		}
+		if pruned > 0 {
+			log.Infof("[%s] prune %d rows of %s before id %d", c, pruned, c.recordTable(), end)
+		}
+	}
+}
+
+// closeTimeout is how long Close waits for the goroutines of the bank case to exit.
+const closeTimeout = time.Minute
+
+// Close stops the bank case and waits for its transfers and verifies to exit,
+// then releases the prepared statements and the status server.
+func (c *BankCase) Close() error {
+	c.markStopped()
+	// Execute may return early without clearing spawn
+	c.workers.mu.Lock()
+	c.workers.spawn = nil
+	c.workers.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.wg.Wait()
 		c.wg.Wait()
-		log.Fatalf("[%s] accouts%s total must %d, but got %d", c, index, check, total)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		return errors.Errorf("goroutines don't exit in %s", closeTimeout)
 	}
 
+	for _, stmts := range c.stmts {
+		stmts.close()
+	}
+	if c.verifyLog != nil {
+		if err := c.verifyLog.close(); err != nil {
+			log.Errorf("[%s] close verify log error %v", c, err)
+		}
+	}
+
+	c.mu.Lock()
+	srv := c.statusServer
+	c.statusServer = nil
+	c.mu.Unlock()
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return errors.Trace(srv.Shutdown(ctx))
+	}
 	return nil
 }
 
-func (c *BankCase) moveMoney(ctx context.Context, db *sql.DB, delay delayMode) {
+// String implements fmt.Stringer interface.
+func (c *BankCase) String() string {
+	return "bank"
+}
+
+// tryDrop will drop table if data incorrect. The existence check is retried
+// on broken connections, it returns error if the retries are exhausted.
+func (c *BankCase) tryDrop(ctx context.Context, db *sql.DB, index string, numAccounts int) (bool, error) {
 	var (
-		from, to, id int
-		index        string
+		count int
+		table string
 	)
-	for {
-		from, to, id = rand.Intn(c.cfg.NumAccounts), rand.Intn(c.cfg.NumAccounts), rand.Intn(c.cfg.TableNum)
-		if from == to {
-			continue
-		}
-		break
+	//if table is not exist ,return true directly
+	query := fmt.Sprintf("show tables like '%s'", c.accountsTable(index))
+	err := c.queryRowWithRetry(ctx, db, query, &table)
+	switch {
+	case errors.Cause(err) == sql.ErrNoRows:
+		return true, nil
+	case err != nil:
+		return false, errors.Annotatef(err, "execute query %s", query)
 	}
-	if id > 0 {
-		index = fmt.Sprintf("%d", id)
+
+	query = fmt.Sprintf("select count(*) as count from %s", c.accountsTable(index))
+	err = c.queryRowWithRetry(ctx, db, query, &count)
+	if err != nil {
+		return false, errors.Annotatef(err, "execute query %s", query)
+	}
+	if count == numAccounts {
+		// the accounts may be numbered by another id scheme
+		var last int
+		query = fmt.Sprintf("select count(*) from %s where id = %d", c.accountsTable(index), c.accountID(numAccounts-1))
+		if err = c.queryRowWithRetry(ctx, db, query, &last); err != nil {
+			return false, errors.Annotatef(err, "execute query %s", query)
+		}
+		if last == 1 {
+			return false, nil
+		}
+		if c.cfg.NoDrop {
+			return false, errors.Errorf("%s isn't numbered by id scheme %s, refuse to drop it for no-drop", c.accountsTable(index), c.cfg.IDScheme)
+		}
+		log.Infof("[%s] %s isn't numbered by id scheme %s, re-initialize the data again", c, c.accountsTable(index), c.cfg.IDScheme)
+		return c.dropAccountsTable(db, index)
 	}
 
-	amount := rand.Intn(999)
+	if c.cfg.NoDrop {
+		// the missing accounts are inserted and the balances are reset by upsert,
+		// the extra accounts can't be repaired
+		if !c.cfg.InitUpsert || count > numAccounts {
+			return false, errors.Errorf("we need %d %s but got %d, refuse to drop it for no-drop, it can be repaired in place by init-upsert if it has fewer accounts",
+				numAccounts, c.accountsTable(index), count)
+		}
+		log.Infof("[%s] we need %d %s but got %d, repair the data in place", c, numAccounts, c.accountsTable(index), count)
+		return true, nil
+	}
+	log.Infof("[%s] we need %d %s but got %d, re-initialize the data again", c, numAccounts, c.accountsTable(index), count)
+	return c.dropAccountsTable(db, index)
+}
 
-	err := c.execTransaction(ctx, db, from, to, amount, index, delay)
+// dropAccountsTable drops the accounts table with the suffix index, the
+// record table shared by all accounts tables is dropped by initRecordTable.
+func (c *BankCase) dropAccountsTable(db *sql.DB, index string) (bool, error) {
+	if _, err := db.Exec(fmt.Sprintf("drop table if exists %s", c.accountsTable(index))); err != nil {
+		return false, errors.Trace(err)
+	}
+	return true, nil
+}
 
+// queryRowWithRetry scans the row of query into dest, the query is retried
+// only if the connection is broken.
+func (c *BankCase) queryRowWithRetry(ctx context.Context, db *sql.DB, query string, dest ...interface{}) error {
+	var queryErr error
+	err := RunWithRetry(ctx, c.cfg.RetryLimit, time.Second, func() error {
+		queryErr = db.QueryRowContext(ctx, query).Scan(dest...)
+		if IsConnClosed(queryErr) {
+			log.Warnf("[%s] execute query %s error %v, retry", c, query, queryErr)
+			return queryErr
+		}
+		// sql.ErrNoRows and other errors are not retried
+		return nil
+	})
 	if err != nil {
-		return
+		return errors.Trace(err)
 	}
+	if queryErr == nil {
+		// RunWithRetry returns nil if ctx is done
+		queryErr = ctx.Err()
+	}
+	return queryErr
 }
 
-func (c *BankCase) execTransaction(ctx context.Context, db *sql.DB, from, to int, amount int, index string, delay delayMode) error {
+// verify checks the balances of the accounts table, the check is delayed by
+// delay after the transaction begins. It returns a mismatchError if the data
+// violates the invariants.
+func (c *BankCase) verify(ctx context.Context, db *sql.DB, verifier string, id int, delay time.Duration) (err error) {
+	var total *big.Int
+	index, numAccounts := tableIndex(id), c.cfg.NumAccounts[id]
+	defer func() {
+		if err != nil {
+			err = errors.Annotatef(err, "%s verify %s with delay %s", verifier, c.accountsTable(index), delay)
+		}
+	}()
+
 	tx, err := db.Begin()
 	if err != nil {
 		return errors.Trace(err)
@@ -338,126 +1241,999 @@ func (c *BankCase) execTransaction(ctx context.Context, db *sql.DB, from, to int
 
 	defer tx.Rollback()
 
-	if delay == delayRead {
-		err = c.delay(ctx)
+	if delay > 0 {
+		err = c.delay(ctx, delay)
 		if err != nil {
 			return err
 		}
 	}
 
-	rows, err := tx.Query(fmt.Sprintf("SELECT id, balance FROM accounts%s WHERE id IN (%d, %d) FOR UPDATE", index, from, to))
-	if err != nil {
+	var (
+		check      *big.Int
+		count      int
+		minBalance *big.Int
+	)
+	if c.cfg.VerifyMode == VerifyRangeSample {
+		total, check, err = c.sampleRange(ctx, tx, index, numAccounts)
+		if err != nil {
+			log.Errorf("[%s] sample range error %v", c, err)
+			return errors.Trace(err)
+		}
+	} else {
+		var sum, least []byte
+		// a corruption may keep the sum but lose accounts or overdraw one
+		query := fmt.Sprintf("select %scount(*), sum(balance) as total, min(balance) from %s", c.verifyHint(), c.accountsTable(index))
+		err = tx.QueryRow(query).Scan(&count, &sum, &least)
+		if err != nil {
+			log.Errorf("[%s] select sum error %v", c, err)
+			return errors.Trace(err)
+		}
+		if total, err = parseBigInt(sum); err != nil {
+			return errors.Trace(err)
+		}
+		if minBalance, err = parseBigInt(least); err != nil {
+			return errors.Trace(err)
+		}
+		check = c.initialSum(numAccounts)
+	}
+	var tso uint64
+	if TiDBDatabase {
+		if err = tx.QueryRow("select @@tidb_current_ts").Scan(&tso); err != nil {
+			return errors.Trace(err)
+		}
+		log.Infof("[%s] %s select sum(balance) of %s to verify use tso %d", c, verifier, c.accountsTable(index), tso)
+		c.observeTSOSpread(verifier, tso)
+	}
+	if c.cfg.VerifySnapshotStability > 0 {
+		if err = c.verifySnapshotStability(ctx, tx, index, total); err != nil {
+			return err
+		}
+	}
+	if c.cfg.TrackUpdatedAt {
+		if err = c.verifyUpdatedAt(ctx, tx, index); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.GeneratedColumn {
+		if err = c.verifyGeneratedColumn(ctx, tx, index, numAccounts); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.WithIndex {
+		if err = c.verifyIndex(ctx, db, tx, index); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.VerifyDistinct {
+		if err = c.verifyDistinct(ctx, tx, index); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.MultibyteRemark {
+		if err = c.verifyRemark(ctx, tx, index, numAccounts); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.VerifyLostUpdate {
+		if err = c.verifyLostUpdate(ctx, tx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.cfg.VerifyTSOOrder {
+		if err = c.verifyTSOOrder(ctx, tx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// the sum can't be trusted if the snapshot fails to commit, let the next round verify again
+	if err = tx.Commit(); err != nil {
+		log.Errorf("[%s] commit verify transaction error %v", c, err)
 		return errors.Trace(err)
 	}
-	defer rows.Close()
+	c.observeDrift(verifier, c.accountsTable(index), new(big.Int).Sub(total, check))
+	if c.verifyLog != nil {
+		c.verifyLog.write(tso, c.accountsTable(index), total, check)
+	}
+	if total.Cmp(check) != 0 {
+		return mismatchError{errors.Errorf("%s total must %d, but got %d", c.accountsTable(index), check, total)}
+	}
+	// only the full sum reads the count and the min balance
+	if minBalance != nil {
+		if !c.countMatches(count, numAccounts) {
+			return mismatchError{errors.Errorf("%s count must %d, but got %d", c.accountsTable(index), numAccounts, count)}
+		}
+		if minBalance.Sign() < 0 {
+			return mismatchError{errors.Errorf("%s min balance must not be negative, but got %d", c.accountsTable(index), minBalance)}
+		}
+	}
+
+	return nil
+}
+
+// observeDrift records drift, how much more money table has than it should,
+// so a slow leak is visible as a trend. With OnMismatchContinue the mismatches
+// don't stop the bank case, it stops once the drift exceeds MaxDrift.
+func (c *BankCase) observeDrift(verifier, table string, drift *big.Int) {
+	v := new(expvar.String)
+	v.Set(drift.String())
+	balanceDrift.Set(table, v)
+	log.Infof("[%s] %s verify %s balance drift %d", c, verifier, table, drift)
+	if c.cfg.MaxDrift > 0 && new(big.Int).Abs(drift).Cmp(big.NewInt(c.cfg.MaxDrift)) > 0 {
+		c.stop(errors.Errorf("%s balance drift %d exceeds max-drift %d", table, drift, c.cfg.MaxDrift))
+	}
+}
+
+// verifyRetryInterval is the interval between the retries of a verify.
+const verifyRetryInterval = 100 * time.Millisecond
+
+// verifyWithRetry verifies the id-th table, it retries at once up to
+// VerifyRetry times on the transient errors like broken connections and
+// failed commits instead of waiting for the next round. The mismatches are
+// never retried.
+func (c *BankCase) verifyWithRetry(ctx context.Context, db *sql.DB, verifier string, id int, delay time.Duration) error {
+	for retries := 0; ; retries++ {
+		err := c.verify(ctx, db, verifier, id, delay)
+		if err == nil || isMismatch(err) || !IsRetryable(err) || retries >= c.cfg.VerifyRetry {
+			return err
+		}
+		log.Warnf("[%s] %s verify error %v, retry %d", c, verifier, err, retries+1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(verifyRetryInterval):
+		}
+	}
+}
+
+// verifyHint returns the optimizer hint comment of the verify sums, or an
+// empty string if VerifyHint isn't set.
+func (c *BankCase) verifyHint() string {
+	if c.cfg.VerifyHint == "" {
+		return ""
+	}
+	return fmt.Sprintf("/*+ %s */ ", c.cfg.VerifyHint)
+}
 
+// verifyUpdatedAt checks no account has an updated_at older than the tso of
+// the last transfer the record table shows on it.
+func (c *BankCase) verifyUpdatedAt(ctx context.Context, tx *sql.Tx, index string) error {
 	var (
-		fromBalance int
-		toBalance   int
-		count       int
+		id             int
+		updatedAt, tso uint64
 	)
+	query := fmt.Sprintf(`select a.id, a.updated_at, r.tso from %[1]s a join
+    (select id, max(tso) as tso from
+        (select from_id as id, tso from %[2]s union all select to_id as id, tso from %[2]s) t
+    group by id) r on a.id = r.id
+    where a.updated_at < r.tso limit 1`, c.accountsTable(index), c.recordTable())
+	err := tx.QueryRowContext(ctx, query).Scan(&id, &updatedAt, &tso)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		log.Errorf("[%s] select updated_at error %v", c, err)
+		return errors.Trace(err)
+	}
+	return mismatchError{errors.Errorf("%s id %d updated_at %d is older than the record tso %d", c.accountsTable(index), id, updatedAt, tso)}
+}
+
+// verifyGeneratedColumn checks balance_category matches the balance for a random
+// range of accounts, both through the primary key and through idx_balance_category.
+func (c *BankCase) verifyGeneratedColumn(ctx context.Context, tx *sql.Tx, index string, numAccounts int) error {
+	size := c.cfg.VerifySampleSize
+	if size <= 0 || size > numAccounts {
+		size = numAccounts
+	}
+	lo := rand.Intn(numAccounts - size + 1)
+	lo, hi := c.idRange(lo, lo+size-1)
+
+	var (
+		id                int
+		balance, category uint64
+	)
+	query := fmt.Sprintf("select id, balance, balance_category from %s where id between %d and %d and balance_category <> balance DIV 1000 limit 1", c.accountsTable(index), lo, hi)
+	err := tx.QueryRowContext(ctx, query).Scan(&id, &balance, &category)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		log.Errorf("[%s] select balance_category error %v", c, err)
+		return errors.Trace(err)
+	default:
+		return mismatchError{errors.Errorf("%s id %d balance %d has balance_category %d", c.accountsTable(index), id, balance, category)}
+	}
+
+	// the index must have an entry for every row of the range
+	var count, indexCount int
+	query = fmt.Sprintf("select count(*) from %s where id between %d and %d", c.accountsTable(index), lo, hi)
+	if err = tx.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return errors.Trace(err)
+	}
+	query = fmt.Sprintf("select count(*) from %s force index (idx_balance_category) where id between %d and %d and balance_category >= 0", c.accountsTable(index), lo, hi)
+	if err = tx.QueryRowContext(ctx, query).Scan(&indexCount); err != nil {
+		return errors.Trace(err)
+	}
+	if count != indexCount {
+		return mismatchError{errors.Errorf("%s [%d, %d] has %d rows but idx_balance_category has %d", c.accountsTable(index), lo, hi, count, indexCount)}
+	}
+	return nil
+}
+
+// verifyIndex checks idx_balance is consistent with the rows. TiDB checks it
+// by ADMIN CHECK TABLE, other databases compare the row counts read through
+// the index and through the table in tx.
+func (c *BankCase) verifyIndex(ctx context.Context, db *sql.DB, tx *sql.Tx, index string) error {
+	if TiDBDatabase {
+		_, err := db.ExecContext(ctx, fmt.Sprintf("admin check table %s", c.accountsTable(index)))
+		if IsErrAdminCheck(err) {
+			return mismatchError{errors.Annotatef(err, "admin check table %s", c.accountsTable(index))}
+		}
+		return errors.Trace(err)
+	}
+
+	var indexCount, tableCount int
+	query := fmt.Sprintf("select count(*) from %s force index (idx_balance) where balance >= 0", c.accountsTable(index))
+	if err := tx.QueryRowContext(ctx, query).Scan(&indexCount); err != nil {
+		return errors.Trace(err)
+	}
+	query = fmt.Sprintf("select count(*) from %s ignore index (idx_balance)", c.accountsTable(index))
+	if err := tx.QueryRowContext(ctx, query).Scan(&tableCount); err != nil {
+		return errors.Trace(err)
+	}
+	if indexCount != tableCount {
+		return mismatchError{errors.Errorf("%s has %d rows but idx_balance has %d", c.accountsTable(index), tableCount, indexCount)}
+	}
+	return nil
+}
+
+// verifyDistinct checks the ids of the accounts table are distinct, it reports
+// at most 10 duplicated ids.
+func (c *BankCase) verifyDistinct(ctx context.Context, tx *sql.Tx, index string) error {
+	var count, distinct int
+	query := fmt.Sprintf("select count(*), count(distinct id) from %s", c.accountsTable(index))
+	if err := tx.QueryRowContext(ctx, query).Scan(&count, &distinct); err != nil {
+		log.Errorf("[%s] select distinct id error %v", c, err)
+		return errors.Trace(err)
+	}
+	if count == distinct {
+		return nil
+	}
 
+	query = fmt.Sprintf("select id from %s group by id having count(*) > 1 limit 10", c.accountsTable(index))
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+	var ids []string
 	for rows.Next() {
-		var id, balance int
-		if err = rows.Scan(&id, &balance); err != nil {
+		var id int
+		if err = rows.Scan(&id); err != nil {
 			return errors.Trace(err)
 		}
-		switch id {
-		case from:
-			fromBalance = balance
-		case to:
-			toBalance = balance
-		default:
-			log.Fatalf("[%s] got unexpected account %d", c, id)
+		ids = append(ids, fmt.Sprintf("%d", id))
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	return mismatchError{errors.Errorf("%s has %d rows but %d distinct ids, duplicated ids [%s]", c.accountsTable(index), count, distinct, strings.Join(ids, ", "))}
+}
+
+// mismatchError means the data violates the invariants of the bank case.
+type mismatchError struct {
+	error
+}
+
+func isMismatch(err error) bool {
+	_, ok := errors.Cause(err).(mismatchError)
+	return ok
+}
+
+// sampleRange sums the balances of a random range of accounts, the expected sum
+// is the initial balances of the range plus the net amount the record table
+// shows transferred into it.
+func (c *BankCase) sampleRange(ctx context.Context, tx *sql.Tx, index string, numAccounts int) (total *big.Int, check *big.Int, err error) {
+	size := c.cfg.VerifySampleSize
+	if size > numAccounts {
+		size = numAccounts
+	}
+	lo := rand.Intn(numAccounts - size + 1)
+	lo, hi := c.idRange(lo, lo+size-1)
+
+	var (
+		count int
+		sum   []byte
+	)
+	query := fmt.Sprintf("select count(*), ifnull(sum(balance), 0) from %s where id between %d and %d", c.accountsTable(index), lo, hi)
+	if err = tx.QueryRowContext(ctx, query).Scan(&count, &sum); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if total, err = parseBigInt(sum); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var delta int
+	query = fmt.Sprintf(`select ifnull(sum(case when to_id between %[1]d and %[2]d then amount else 0 end), 0) -
+    ifnull(sum(case when from_id between %[1]d and %[2]d then amount else 0 end), 0)
+    from %[3]s where from_id between %[1]d and %[2]d or to_id between %[1]d and %[2]d`, lo, hi, c.recordTable())
+	if err = tx.QueryRowContext(ctx, query).Scan(&delta); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	log.Infof("[%s] sample %s [%d, %d] count %d, transferred in %d", c, c.accountsTable(index), lo, hi, count, delta)
+	check = c.initialSum(count)
+	return total, check.Add(check, big.NewInt(int64(delta))), nil
+}
+
+// initialSum returns the sum of the initial balances of count accounts, it
+// may exceed 64 bits with unsigned balances.
+func (c *BankCase) initialSum(count int) *big.Int {
+	sum := new(big.Int).SetUint64(c.cfg.InitialBalance)
+	return sum.Mul(sum, big.NewInt(int64(count)))
+}
+
+// maxBalance returns the max value the balance column can hold.
+func (c *BankCase) maxBalance() uint64 {
+	if c.cfg.UnsignedBalance {
+		return math.MaxUint64
+	}
+	return math.MaxInt64
+}
+
+// parseBigInt parses the result of sum(), which is a DECIMAL.
+func parseBigInt(b []byte) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(string(b), 10)
+	if !ok {
+		return nil, errors.Errorf("invalid integer %q", b)
+	}
+	return n, nil
+}
+
+// worker is the state of a goroutine running transfers.
+type worker struct {
+	rng   *rand.Rand
+	delay delayMode
+	// txnMode is the txn mode of the transactions, the global txn mode is used if empty
+	txnMode string
+	// transfers is the number of the transfers the worker has applied
+	transfers int
+	// conn is the connection pinned by the worker if PinConn is set
+	conn *sql.Conn
+	// records are the records of the transaction to send to recordCh after
+	// it commits if RecordAsync is set
+	records [][]interface{}
+}
+
+// unpin closes the pinned connection, the next transaction pins a new one.
+func (w *worker) unpin() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// pessimisticWorkers returns how many of the first n workers are in
+// pessimistic txn mode for ratio.
+func pessimisticWorkers(ratio float64, n int) int {
+	return int(ratio*float64(n) + 0.5)
+}
+
+// recoverPanic runs an operation of w and recovers from its panic, the panic
+// is logged and counted and the worker goes on with the next operation. The
+// pinned connection may be in any state, so it's closed.
+func (c *BankCase) recoverPanic(w *worker, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			workerPanics.Add(1)
+			log.Errorf("[%s] worker panic: %v\n%s", c, r, debug.Stack())
+			w.unpin()
 		}
+	}()
+	f()
+}
 
-		count++
+// newRand returns the random source of the worker-th worker, it's derived
+// from the seed if the seed is set.
+func (c *BankCase) newRand(worker int) *rand.Rand {
+	seed := time.Now().UnixNano()
+	if c.cfg.Seed != 0 {
+		seed = c.cfg.Seed + int64(worker)
 	}
+	return rand.New(rand.NewSource(seed))
+}
 
-	if err = rows.Err(); err != nil {
-		return errors.Trace(err)
+// Read-only query kinds.
+const (
+	readPoint = "point"
+	readRange = "range"
+)
+
+// readRangeSize is the number of accounts a range read sums.
+const readRangeSize = 100
+
+// readAccounts runs a read-only query on a random accounts table, either a
+// point select or a range sum. It doesn't affect the invariants.
+func (c *BankCase) readAccounts(ctx context.Context, db *sql.DB, w *worker) {
+	id := w.rng.Intn(c.cfg.TableNum)
+	table, numAccounts := c.accountsTable(tableIndex(id)), c.cfg.NumAccounts[id]
+
+	kind := readPoint
+	query := fmt.Sprintf("select balance from %s where id = %d", table, c.accountID(w.rng.Intn(numAccounts)))
+	if w.rng.Intn(2) == 0 {
+		kind = readRange
+		lo := w.rng.Intn(numAccounts)
+		lo, hi := c.idRange(lo, lo+readRangeSize-1)
+		query = fmt.Sprintf("select ifnull(sum(balance), 0) from %s where id between %d and %d", table, lo, hi)
 	}
 
-	if count != 2 {
-		log.Fatalf("[%s] select %d(%d) -> %d(%d) invalid count %d", c, from, fromBalance, to, toBalance, count)
+	var result []byte
+	if err := db.QueryRowContext(ctx, query).Scan(&result); err != nil {
+		c.count(readFailed, kind)
+		if ctx.Err() == nil && atomic.LoadInt32(&c.stopped) == 0 {
+			log.Errorf("[%s] read %s error %v", c, query, err)
+		}
+		return
 	}
+	c.count(readQueries, kind)
+}
 
-	var update string
-	if fromBalance >= amount {
-		update = fmt.Sprintf(`
-UPDATE accounts%s
-  SET balance = CASE id WHEN %d THEN %d WHEN %d THEN %d END
-  WHERE id IN (%d, %d)
-`, index, to, toBalance+amount, from, fromBalance-amount, from, to)
-		_, err = tx.Exec(update)
-		if err != nil {
-			return errors.Trace(err)
+// moveMoney transfers money between two random accounts.
+func (c *BankCase) moveMoney(ctx context.Context, db *sql.DB, w *worker) {
+	if err := c.txnLimiter.Wait(ctx); err != nil {
+		// ctx is done
+		return
+	}
+
+	if c.cfg.DebugVerifyEach {
+		c.debugVerifyMu.Lock()
+		defer c.debugVerifyMu.Unlock()
+	}
+
+	id := w.rng.Intn(c.cfg.TableNum)
+	numAccounts := c.cfg.NumAccounts[id]
+	txnSize := c.cfg.TxnSize
+	if txnSize < 1 {
+		txnSize = 1
+	}
+	transfers := make([]transferArgs, txnSize)
+	for i := range transfers {
+		t := &transfers[i]
+		for {
+			t.from, t.to = c.accountID(w.rng.Intn(numAccounts)), c.accountID(w.rng.Intn(numAccounts))
+			if t.from == t.to {
+				continue
+			}
+			break
 		}
+		t.amount = c.randAmount(w.rng)
+	}
+	from, to, amount := transfers[0].from, transfers[0].to, transfers[0].amount
+	start := time.Now()
 
-		var tso uint64
-		if TiDBDatabase {
-			if err = tx.QueryRow("select @@tidb_current_ts").Scan(&tso); err != nil {
-				return err
+	// only the retryable errors are retried, others are kept in txnErr.
+	// finished is set once a transaction is not retried
+	var (
+		txnErr   error
+		finished bool
+	)
+	attempts, err := RunWithRetryAttempts(ctx, c.cfg.RetryLimit, txnRetryInterval, func() error {
+		start := time.Now()
+		err := c.execTransaction(ctx, db, w, transfers, c.stmts[id])
+		c.logSlowTxn(w, from, to, amount, time.Since(start))
+		if err != nil && (isChaos(err) || IsConnClosed(err)) {
+			w.unpin()
+		}
+		if err != nil && isChaos(err) {
+			c.countTxn(txnChaosKilled, w.txnMode)
+			return err
+		}
+		if err != nil && IsDeadlock(err) {
+			c.countTxn(txnDeadlock, w.txnMode)
+			if c.cfg.LogDeadlock {
+				log.Warnf("[%s] transfer %d -> %d on %s deadlocks in txn mode %s, retry", c, from, to, c.accountsTable(tableIndex(id)), metricsTxnMode(w.txnMode))
 			}
-		} else {
-			tso = uint64(time.Now().UnixNano())
+			return err
+		}
+		if err != nil && IsLockNowait(err) {
+			c.countTxn(txnLockNowait, w.txnMode)
+			return err
+		}
+		if err != nil && IsRetryable(err) {
+			c.countTxn(txnRetryableError, w.txnMode)
+			return err
+		}
+		txnErr, finished = err, true
+		return nil
+	})
+	if err == nil {
+		err = txnErr
+	}
+	if err == nil && !finished {
+		// RunWithRetry returns nil if ctx is done between the retries
+		err = errors.Annotate(ctx.Err(), "transfer is cancelled")
+	}
+
+	if err == nil {
+		c.countTxn(txnCommitted, w.txnMode)
+		c.count(txnAttempts, attemptsKey(attempts))
+		if w.delay != delayRead && w.delay != delayCommit && atomic.LoadInt32(&c.warmedUp) != 0 {
+			txnLatency.observe(time.Since(start))
+		}
+		if c.cfg.DebugVerifyEach {
+			c.verifyTransfer(ctx, db, w, id, transfers)
+		}
+		return
+	}
+	c.countTxn(txnFailed, w.txnMode)
+	if ctx.Err() == nil && atomic.LoadInt32(&c.stopped) == 0 {
+		log.Errorf("[%s] %v", c, err)
+	}
+}
+
+// logSlowTxn warns if a transfer takes longer than SlowTxnThreshold. The
+// long-term transactions are slow on purpose, they're never logged.
+func (c *BankCase) logSlowTxn(w *worker, from, to, amount int, d time.Duration) {
+	if c.cfg.SlowTxnThreshold <= 0 || d <= c.cfg.SlowTxnThreshold {
+		return
+	}
+	if w.delay == delayRead || w.delay == delayCommit {
+		return
+	}
+	log.Warnf("[%s] slow transfer %d -> %d amount %d takes %s", c, from, to, amount, d)
+}
+
+// transferArgs are the accounts and amount of a transfer.
+type transferArgs struct {
+	from, to, amount int
+}
+
+// execTransaction applies the transfers in one transaction.
+func (c *BankCase) execTransaction(ctx context.Context, db *sql.DB, w *worker, transfers []transferArgs, stmts *transferStmts) (err error) {
+	from, to, amount := transfers[0].from, transfers[0].to, transfers[0].amount
+	// the annotation keeps the cause, the retryable errors are still retried
+	defer func() {
+		if err != nil {
+			var more string
+			if len(transfers) > 1 {
+				more = fmt.Sprintf(" and %d more", len(transfers)-1)
+			}
+			err = errors.Annotatef(err, "transfer %d -> %d amount %d%s on %s by %s worker in txn mode %s",
+				from, to, amount, more, stmts.accountsTable, delayModeName(w.delay), metricsTxnMode(w.txnMode))
+		}
+	}()
+
+	tx, release, err := c.begin(ctx, db, w)
+	if err != nil {
+		return errors.Annotate(err, "begin")
+	}
+
+	defer release()
+	defer tx.Rollback()
+
+	if w.delay == delayRead {
+		err = c.delay(ctx, c.delayDuration(w.rng))
+		if err != nil {
+			return err
 		}
-		if _, err = tx.Exec(fmt.Sprintf(`
-INSERT INTO record (from_id, to_id, from_balance, to_balance, amount, tso)
-    VALUES (%d, %d, %d, %d, %d, %d)`, from, to, fromBalance, toBalance, amount, tso)); err != nil {
+	}
+
+	var (
+		update string
+		tso    uint64
+	)
+	w.records = w.records[:0]
+	for _, t := range transfers {
+		var u string
+		if u, err = c.transfer(ctx, tx, w, stmts, t.from, t.to, t.amount, &tso); err != nil {
 			return err
 		}
-		log.Infof("[%s] exec pre: %s", c, update)
+		if u != "" {
+			update = u
+		}
 	}
 
-	if delay == delayCommit {
-		err = c.delay(ctx)
+	if w.delay == delayCommit {
+		err = c.delay(ctx, c.delayDuration(w.rng))
 		if err != nil {
 			return err
 		}
 	}
 
+	if c.cfg.ChaosKillConnRatio > 0 && w.rng.Float64() < c.cfg.ChaosKillConnRatio {
+		return c.killConn(ctx, db, tx)
+	}
+
 	err = tx.Commit()
-	if fromBalance >= amount {
+	if err == nil {
+		for _, args := range w.records {
+			c.recordCh <- args
+		}
+	}
+	if update != "" {
 		if err != nil {
 			log.Infof("[%s] exec commit error: %s\n err:%s", c, update, err)
 		}
 		if err == nil {
 			log.Infof("[%s] exec commit success: %s", c, update)
+			if TiDBDatabase {
+				c.observeWriteTSO(tso)
+			}
+		}
+	}
+	return errors.Annotatef(err, "commit at tso %d", tso)
+}
+
+// transfer applies a transfer in tx, it returns the update statement, or an
+// empty string if the transfer is skipped. The tso of tx is read into tso
+// by the first transfer applied.
+func (c *BankCase) transfer(ctx context.Context, tx *sql.Tx, w *worker, stmts *transferStmts, from, to, amount int, tso *uint64) (string, error) {
+	fromBalance, toBalance, err := c.readBalances(ctx, tx, stmts, from, to)
+	if err == errAccountClosed {
+		// the account is closed by the churn, skip the transfer
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Annotate(err, "read balances")
+	}
+
+	// the transfer is skipped if the from account doesn't have enough money,
+	// or the to account would overflow
+	if ok, overflow := c.transferable(fromBalance, toBalance, amount); !ok {
+		if overflow {
+			log.Warnf("[%s] transfer %d -> %d(%d) amount %d overflows the balance, skip it", c, from, to, toBalance, amount)
+		}
+		return "", nil
+	}
+
+	if *tso == 0 {
+		if TiDBDatabase {
+			if err = tx.QueryRow("select @@tidb_current_ts").Scan(tso); err != nil {
+				return "", errors.Annotate(err, "select tso")
+			}
+		} else {
+			*tso = uint64(time.Now().UnixNano())
+		}
+	}
+
+	// applied is set if the update is kept by the savepoint transfer
+	var applied bool
+	if w.delay == savepointMode {
+		if amount, applied, err = c.rollbackToSavepoint(ctx, tx, w, stmts, from, to, fromBalance, toBalance, amount, *tso); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+
+	updateArgs := stmts.updateArgs(from, to, fromBalance, toBalance, amount, *tso)
+	update := bindArgs(stmts.updateSQL, updateArgs...)
+	if !applied {
+		if _, err = stmts.exec(ctx, tx, stmts.updateStmt, stmts.updateSQL, updateArgs...); err != nil {
+			return "", errors.Annotatef(err, "update at tso %d", *tso)
+		}
+	}
+
+	if c.cfg.RecordAsync {
+		w.records = append(w.records, stmts.insertArgs(from, to, fromBalance, toBalance, amount, *tso))
+	} else if !c.cfg.DisableRecord {
+		if _, err = stmts.exec(ctx, tx, stmts.insertStmt, stmts.insertSQL, stmts.insertArgs(from, to, fromBalance, toBalance, amount, *tso)...); err != nil {
+			return "", errors.Annotatef(err, "insert record at tso %d", *tso)
 		}
 	}
+	log.Infof("[%s] exec pre: %s", c, update)
+
+	w.transfers++
+	if c.cfg.MicroVerifyEvery > 0 && w.transfers%c.cfg.MicroVerifyEvery == 0 {
+		if err = c.microVerify(ctx, tx, w, stmts, from, to, fromBalance, toBalance, amount, *tso); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	return update, nil
+}
+
+// microVerify re-reads the two accounts of a transfer in its transaction, they
+// must have the balances the transfer just wrote.
+func (c *BankCase) microVerify(ctx context.Context, tx *sql.Tx, w *worker, stmts *transferStmts, from, to int, fromBalance, toBalance uint64, amount int, tso uint64) error {
+	curFrom, curTo, err := c.readBalances(ctx, tx, stmts, from, to)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	wantFrom, wantTo := fromBalance-uint64(amount), toBalance+uint64(amount)
+	if curFrom == wantFrom && curTo == wantTo {
+		return nil
+	}
+	err = invariantViolation("transfer %d(%d) -> %d(%d) amount %d at tso %d in txn mode %s reads %d(%d) -> %d(%d), want %d(%d) -> %d(%d)",
+		from, fromBalance, to, toBalance, amount, tso, metricsTxnMode(w.txnMode), from, curFrom, to, curTo, from, wantFrom, to, wantTo)
+	c.stop(err)
 	return err
 }
 
-func (c *BankCase) delay(ctx context.Context) error {
-	start := time.Now()
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	delayDuration := minDelayDuration + time.Duration(rand.Int63n(int64(maxDelayDuration-minDelayDuration)))
-	for {
-		select {
-		case <-ctx.Done():
-			return errors.New("context canceled")
-		case <-ticker.C:
-			if atomic.LoadInt32(&c.stopped) != 0 {
-				return errors.New("stopped")
+// killConn kills the connection of tx to simulate a network drop before the
+// transaction commits. It always returns a chaosError, the transaction must be
+// rolled back.
+func (c *BankCase) killConn(ctx context.Context, db *sql.DB, tx *sql.Tx) error {
+	var connID uint64
+	if err := tx.QueryRowContext(ctx, "select connection_id()").Scan(&connID); err != nil {
+		return chaosError{errors.Annotate(err, "select connection id")}
+	}
+	kill := "kill %d"
+	if TiDBDatabase {
+		kill = "kill tidb %d"
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(kill, connID)); err != nil {
+		return chaosError{errors.Annotatef(err, "kill connection %d", connID)}
+	}
+	return chaosError{errors.Errorf("connection %d is killed by chaos", connID)}
+}
+
+// chaosError is the error of a transaction failed by chaos on purpose.
+type chaosError struct {
+	error
+}
+
+func isChaos(err error) bool {
+	_, ok := errors.Cause(err).(chaosError)
+	return ok
+}
+
+// randAmount returns a random transfer amount in [AmountMin, AmountMax].
+func (c *BankCase) randAmount(rng *rand.Rand) int {
+	min, max := c.cfg.AmountMin, c.cfg.AmountMax
+	if c.cfg.AmountDist != AmountNormal {
+		return min + rng.Intn(max-min+1)
+	}
+
+	// most amounts are within 3 standard deviations
+	mean, stddev := float64(min+max)/2, float64(max-min)/6
+	amount := int(math.Round(rng.NormFloat64()*stddev + mean))
+	if amount < min {
+		return min
+	}
+	if amount > max {
+		return max
+	}
+	return amount
+}
+
+// begin starts a transaction in txnMode, or in the global txn mode if txnMode
+// is empty. release must be called after the transaction finishes.
+func (c *BankCase) begin(ctx context.Context, db *sql.DB, w *worker) (tx *sql.Tx, release func(), err error) {
+	if c.cfg.PinConn {
+		return c.beginPinned(ctx, db, w)
+	}
+	txnMode := w.txnMode
+	if txnMode == "" {
+		tx, err = db.Begin()
+		return tx, func() {}, err
+	}
+
+	// the session variable only affects the connection, so the transaction
+	// must begin on the same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("set @@session.tidb_txn_mode = '%s'", txnMode)); err != nil {
+		conn.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
+		conn.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	return tx, func() { conn.Close() }, nil
+}
+
+// beginPinned begins a transaction on the connection pinned by w, the
+// connection is pinned and its session variables are set on first use.
+func (c *BankCase) beginPinned(ctx context.Context, db *sql.DB, w *worker) (*sql.Tx, func(), error) {
+	if w.conn == nil {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if w.txnMode != "" {
+			if _, err = conn.ExecContext(ctx, fmt.Sprintf("set @@session.tidb_txn_mode = '%s'", w.txnMode)); err != nil {
+				conn.Close()
+				return nil, nil, errors.Trace(err)
 			}
-			if time.Since(start) > delayDuration {
-				return nil
+		}
+		w.conn = conn
+	}
+	tx, err := w.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return tx, func() {}, nil
+}
+
+// readBalances locks and reads the balances of the two accounts.
+func (c *BankCase) readBalances(ctx context.Context, tx *sql.Tx, stmts *transferStmts, from, to int) (fromBalance uint64, toBalance uint64, err error) {
+	var count int
+	read := func(stmt *sql.Stmt, query string, ids ...int) error {
+		rows, err := stmts.query(ctx, tx, stmt, query, stmts.keyArgs(ids...)...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				id      int
+				balance uint64
+			)
+			if err = rows.Scan(&id, &balance); err != nil {
+				return errors.Trace(err)
+			}
+			switch id {
+			case from:
+				fromBalance = balance
+			case to:
+				toBalance = balance
+			default:
+				err = invariantViolation("got unexpected account %d", id)
+				c.stop(err)
+				return err
 			}
+
+			count++
+		}
+		return errors.Trace(rows.Err())
+	}
+
+	switch first, second := from, to; c.cfg.LockOrder {
+	case LockOrderAscending, LockOrderFromTo:
+		if c.cfg.LockOrder == LockOrderAscending && first > second {
+			first, second = second, first
 		}
+		if err = read(stmts.selectOneStmt, stmts.selectOneSQL, first); err == nil {
+			err = read(stmts.selectOneStmt, stmts.selectOneSQL, second)
+		}
+	default:
+		err = read(stmts.selectStmt, stmts.selectSQL, from, to)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if count < 2 && c.cfg.AccountChurn > 0 {
+		return 0, 0, errAccountClosed
+	}
+	if count != 2 {
+		err = invariantViolation("select %d(%d) -> %d(%d) invalid count %d", from, fromBalance, to, toBalance, count)
+		c.stop(err)
+		return 0, 0, err
+	}
+	return fromBalance, toBalance, nil
+}
+
+// rollbackToSavepoint applies the transfer at tso after a savepoint and
+// randomly rolls it back to the savepoint. It returns the amount the
+// transaction should transfer at last and whether the update of it is
+// applied already. The update is left to the caller if the rollback happens,
+// the amount differs then.
+func (c *BankCase) rollbackToSavepoint(ctx context.Context, tx *sql.Tx, w *worker, stmts *transferStmts, from, to int, fromBalance, toBalance uint64, amount int, tso uint64) (int, bool, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT sp1"); err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	if _, err := stmts.exec(ctx, tx, stmts.updateStmt, stmts.updateSQL, stmts.updateArgs(from, to, fromBalance, toBalance, amount, tso)...); err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	if w.rng.Intn(2) == 0 {
+		return amount, true, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT sp1"); err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	curFrom, curTo, err := c.readBalances(ctx, tx, stmts, from, to)
+	if err != nil {
+		return 0, false, errors.Trace(err)
 	}
+	if curFrom != fromBalance || curTo != toBalance {
+		err = invariantViolation("rollback to savepoint got %d(%d) -> %d(%d), want %d(%d) -> %d(%d)",
+			from, curFrom, to, curTo, from, fromBalance, to, toBalance)
+		c.stop(err)
+		return 0, false, err
+	}
+	return c.savepointAmount(fromBalance, toBalance, amount), false, nil
 }
 
+// savepointAmount returns the amount to transfer after the transfer of amount
+// is rolled back, which is non-zero and differs from amount unless the
+// balances only afford amount.
+func (c *BankCase) savepointAmount(fromBalance, toBalance uint64, amount int) int {
+	other := amount / 2
+	if other == 0 {
+		other = amount + 1
+	}
+	if ok, _ := c.transferable(fromBalance, toBalance, other); !ok {
+		return amount
+	}
+	return other
+}
+
+// transferable returns whether amount can be transferred from fromBalance to
+// toBalance, the from balance must not go below 0 and the to balance must not
+// exceed maxBalance. overflow is set if it's the to balance which can't take
+// amount. The checks never overflow themselves.
+func (c *BankCase) transferable(fromBalance, toBalance uint64, amount int) (ok bool, overflow bool) {
+	if amount < 0 || fromBalance < uint64(amount) {
+		return false, false
+	}
+	if limit := c.maxBalance(); uint64(amount) > limit || toBalance > limit-uint64(amount) {
+		return false, true
+	}
+	return true, false
+}
+
+// delayDuration returns a random delay of long-term transactions in [MinDelay, MaxDelay).
+func (c *BankCase) delayDuration(rng *rand.Rand) time.Duration {
+	return c.cfg.MinDelay + time.Duration(rng.Int63n(int64(c.cfg.MaxDelay-c.cfg.MinDelay)))
+}
+
+// delay waits for delayDuration. It returns as soon as ctx is done or the
+// bank case stops.
+func (c *BankCase) delay(ctx context.Context, delayDuration time.Duration) error {
+	timer := time.NewTimer(delayDuration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.New("context canceled")
+	case <-c.stopCh:
+		return errors.New("stopped")
+	case <-timer.C:
+		return nil
+	}
+}
+
+// accountsTable returns the name of the accounts table with the suffix index.
+func (c *BankCase) accountsTable(index string) string {
+	return accountsTableName(c.cfg.TablePrefix, index)
+}
+
+// recordTable returns the name of the record table.
+func (c *BankCase) recordTable() string {
+	return recordTableName(c.cfg.TablePrefix)
+}
+
+// accountsTableName returns the name of the accounts table with prefix and the suffix index.
+func accountsTableName(prefix string, index string) string {
+	return prefix + "accounts" + index
+}
+
+// recordTableName returns the name of the record table with prefix.
+func recordTableName(prefix string) string {
+	return prefix + "record"
+}
+
+// tableIndex returns the suffix of the name of the id-th accounts table.
+func tableIndex(id int) string {
+	if id > 0 {
+		return fmt.Sprintf("%d", id)
+	}
+	return ""
+}
+
+// txnRetryInterval is the interval to retry a transfer failing for conflicts.
+const txnRetryInterval = 10 * time.Millisecond
+
 type delayMode = int
 
 const (
 	noDelay delayMode = iota
 	delayRead
 	delayCommit
+	// savepointMode rolls back part of the transaction to a savepoint
+	savepointMode
 )
 
-const (
-	minDelayDuration = time.Minute*10 - time.Second*10
-	maxDelayDuration = time.Minute*10 + time.Second*10
-)
+// delayModeName returns the name of the workers of delay mode d in errors.
+func delayModeName(d delayMode) string {
+	switch d {
+	case noDelay:
+		return "no-delay"
+	case delayRead:
+		return "delay-read"
+	case delayCommit:
+		return "delay-commit"
+	case savepointMode:
+		return "savepoint"
+	}
+	return fmt.Sprintf("delay-mode-%d", d)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"math"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"go.uber.org/goleak"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// newTestBank returns a bank case of a table of numAccounts accounts for the
+// tests on sqlmock, which is not TiDB.
+func newTestBank(numAccounts int) *BankCase {
+	TiDBDatabase = false
+	return NewBankCase(&Config{
+		TableNum:       1,
+		NumAccounts:    []int{numAccounts},
+		InitialBalance: 1000,
+		RetryLimit:     3,
+		VerifyMode:     VerifyFullSum,
+	})
+}
+
+func TestVerifyFailsOnCommitError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bank := newTestBank(10)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("select count(*), sum(balance) as total, min(balance) from accounts")).
+		WillReturnRows(sqlmock.NewRows([]string{"count(*)", "total", "min(balance)"}).AddRow(10, "10000", "1000"))
+	mock.ExpectCommit().WillReturnError(errors.New("commit aborted"))
+
+	err = bank.verify(context.Background(), db, "test", 0, 0)
+	if err == nil {
+		t.Fatal("verify succeeds on the commit error")
+	}
+	if isMismatch(err) {
+		t.Fatalf("the commit error %v is a mismatch", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// seedFor returns a seed whose random source returns n on the first Intn(2).
+func seedFor(n int) int64 {
+	for seed := int64(1); ; seed++ {
+		if rand.New(rand.NewSource(seed)).Intn(2) == n {
+			return seed
+		}
+	}
+}
+
+func TestSavepointNetEffect(t *testing.T) {
+	const (
+		from, to               = 1, 2
+		fromBalance, toBalance = 100, 50
+	)
+	tests := []struct {
+		name     string
+		rollback bool
+		amount   int
+		// final is the amount the transaction transfers at last
+		final int
+	}{
+		{name: "no rollback", amount: 10, final: 10},
+		{name: "rollback", rollback: true, amount: 10, final: 5},
+		// amount/2 is 0 for amount 1
+		{name: "rollback amount 1", rollback: true, amount: 1, final: 2},
+	}
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bank := newTestBank(10)
+		bank.cfg.DisableRecord = true
+		stmts := bank.stmts[0]
+		selectSQL := regexp.QuoteMeta(bindArgs(stmts.selectSQL, stmts.keyArgs(from, to)...))
+		balances := func() *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"id", "balance"}).AddRow(from, fromBalance).AddRow(to, toBalance)
+		}
+		update := func(amount int) string {
+			return bindArgs(stmts.updateSQL, stmts.updateArgs(from, to, fromBalance, toBalance, amount, 0)...)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSQL).WillReturnRows(balances())
+		mock.ExpectExec("SAVEPOINT sp1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(update(tt.amount))).WillReturnResult(sqlmock.NewResult(0, 2))
+		if tt.rollback {
+			mock.ExpectExec("ROLLBACK TO SAVEPOINT sp1").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(selectSQL).WillReturnRows(balances())
+			mock.ExpectExec(regexp.QuoteMeta(update(tt.final))).WillReturnResult(sqlmock.NewResult(0, 2))
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seed := seedFor(0)
+		if tt.rollback {
+			seed = seedFor(1)
+		}
+		w := &worker{rng: rand.New(rand.NewSource(seed)), delay: savepointMode}
+		// updated_at is not tracked, the tso is not in the updates
+		tso := uint64(1)
+		got, err := bank.transfer(context.Background(), tx, w, stmts, from, to, tt.amount, &tso)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// the update is run exactly once on the path without rollback
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if want := update(tt.final); got != want {
+			t.Fatalf("%s: the transfer applies %q, want %q", tt.name, got, want)
+		}
+		db.Close()
+	}
+}
+
+func TestTryDropRetriesClosedConn(t *testing.T) {
+	// database/sql retries the queries failing with ErrBadConn itself, it's
+	// returned by reading the row then
+	badConn := func(q *sqlmock.ExpectedQuery) {
+		q.WillReturnRows(sqlmock.NewRows([]string{"Tables_in_test"}).AddRow("accounts").RowError(0, driver.ErrBadConn))
+	}
+	invalidConn := func(q *sqlmock.ExpectedQuery) {
+		q.WillReturnError(mysql.ErrInvalidConn)
+	}
+	for connErr, fail := range map[error]func(*sqlmock.ExpectedQuery){driver.ErrBadConn: badConn, mysql.ErrInvalidConn: invalidConn} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bank := newTestBank(10)
+		bank.cfg.IDScheme = IDSequential
+		show := regexp.QuoteMeta("show tables like 'accounts'")
+		fail(mock.ExpectQuery(show))
+		mock.ExpectQuery(show).WillReturnRows(sqlmock.NewRows([]string{"Tables_in_test"}).AddRow("accounts"))
+		mock.ExpectQuery(regexp.QuoteMeta("select count(*) as count from accounts")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+		mock.ExpectQuery(regexp.QuoteMeta("select count(*) from accounts where id = 9")).
+			WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+
+		dropped, err := bank.tryDrop(context.Background(), db, "", 10)
+		if err != nil {
+			t.Fatalf("%v: %v", connErr, err)
+		}
+		if dropped {
+			t.Fatalf("%v: the table of all accounts is dropped", connErr)
+		}
+		// the query failed on the closed connection is retried
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%v: %v", connErr, err)
+		}
+		db.Close()
+	}
+}
+
+func TestCloseAfterExecute(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the transfers fail without expectations, they keep running until ctx is done
+	mock.MatchExpectationsInOrder(false)
+
+	bank := newTestBank(10)
+	bank.cfg.Concurrency = 2
+	bank.txnLimiter = rate.NewLimiter(100, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	executed := make(chan error, 1)
+	go func() {
+		executed <- bank.Execute(ctx, db)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-executed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execute doesn't return after ctx is done")
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- bank.Close()
+	}()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close doesn't return")
+	}
+}
+
+func TestDelayReturnsOnCancel(t *testing.T) {
+	bank := newTestBank(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if err := bank.delay(ctx, 10*time.Minute); err == nil {
+		t.Fatal("the delay cancelled succeeds")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the delay returns in %s after ctx is done", d)
+	}
+
+	// so does it once the bank case stops
+	bank = newTestBank(10)
+	time.AfterFunc(10*time.Millisecond, bank.markStopped)
+	start = time.Now()
+	if err := bank.delay(context.Background(), 10*time.Minute); err == nil {
+		t.Fatal("the delay of the stopped bank case succeeds")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the delay returns in %s after the bank case stops", d)
+	}
+}
+
+func TestTransferableBoundaries(t *testing.T) {
+	tests := []struct {
+		name                   string
+		unsigned               bool
+		fromBalance, toBalance uint64
+		amount                 int
+		ok, overflow           bool
+	}{
+		{name: "to reaches MaxInt64", fromBalance: 10, toBalance: math.MaxInt64 - 10, amount: 10, ok: true},
+		{name: "to exceeds MaxInt64", fromBalance: 10, toBalance: math.MaxInt64 - 9, amount: 10, overflow: true},
+		{name: "to at MaxInt64 gets 0", fromBalance: 10, toBalance: math.MaxInt64, amount: 0, ok: true},
+		{name: "to at MaxInt64 gets 1", fromBalance: 10, toBalance: math.MaxInt64, amount: 1, overflow: true},
+		{name: "amount MaxInt64 to 0", fromBalance: math.MaxInt64, toBalance: 0, amount: math.MaxInt64, ok: true},
+		{name: "amount MaxInt64 to 1", fromBalance: math.MaxInt64, toBalance: 1, amount: math.MaxInt64, overflow: true},
+		{name: "from reaches 0", fromBalance: 10, toBalance: 0, amount: 10, ok: true},
+		// the signed balance would wrap towards MinInt64
+		{name: "from goes below 0", fromBalance: 9, toBalance: 0, amount: 10},
+		{name: "from 0 gives 1", fromBalance: 0, toBalance: 0, amount: 1},
+		{name: "amount MinInt64", fromBalance: 10, toBalance: 0, amount: math.MinInt64},
+		{name: "negative amount", fromBalance: 10, toBalance: math.MaxInt64, amount: -1},
+		{name: "unsigned to over MaxInt64", unsigned: true, fromBalance: 10, toBalance: math.MaxInt64, amount: 10, ok: true},
+		{name: "unsigned to reaches MaxUint64", unsigned: true, fromBalance: 10, toBalance: math.MaxUint64 - 10, amount: 10, ok: true},
+		{name: "unsigned to exceeds MaxUint64", unsigned: true, fromBalance: 10, toBalance: math.MaxUint64 - 9, amount: 10, overflow: true},
+		{name: "unsigned from reaches 0", unsigned: true, fromBalance: math.MaxUint64, toBalance: 0, amount: math.MaxInt64, ok: true},
+	}
+	for _, tt := range tests {
+		bank := newTestBank(10)
+		bank.cfg.UnsignedBalance = tt.unsigned
+		ok, overflow := bank.transferable(tt.fromBalance, tt.toBalance, tt.amount)
+		if ok != tt.ok || overflow != tt.overflow {
+			t.Errorf("%s: transferable(%d, %d, %d) = %v, %v, want %v, %v",
+				tt.name, tt.fromBalance, tt.toBalance, tt.amount, ok, overflow, tt.ok, tt.overflow)
+		}
+		if ok {
+			from, to := tt.fromBalance-uint64(tt.amount), tt.toBalance+uint64(tt.amount)
+			if from > tt.fromBalance || to < tt.toBalance || to > bank.maxBalance() {
+				t.Errorf("%s: the balances wrap to %d -> %d", tt.name, from, to)
+			}
+		}
+	}
+}
+
+func TestErrorAnnotations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bank := newTestBank(10)
+
+	mock.ExpectExec(regexp.QuoteMeta("set @@session.tidb_txn_mode = 'optimistic'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, balance FROM accounts").WillReturnError(errors.New("forced failure"))
+	mock.ExpectRollback()
+	w := &worker{rng: rand.New(rand.NewSource(1)), delay: noDelay, txnMode: txnModeOptimistic}
+	err = bank.execTransaction(context.Background(), db, w, []transferArgs{{from: 1, to: 2, amount: 5}, {from: 3, to: 4, amount: 6}}, bank.stmts[0])
+	if err == nil {
+		t.Fatal("the transfer succeeds on the forced failure")
+	}
+	want := "transfer 1 -> 2 amount 5 and 1 more on accounts by no-delay worker in txn mode optimistic"
+	if !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "forced failure") {
+		t.Fatalf("got %v, want the annotation %q", err, want)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select count").WillReturnError(errors.New("forced failure"))
+	mock.ExpectRollback()
+	err = bank.verify(context.Background(), db, "test", 0, 0)
+	want = "test verify accounts with delay 0s"
+	if err == nil || !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "forced failure") {
+		t.Fatalf("got %v, want the annotation %q", err, want)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	bank := newTestBank(10)
+	w := &worker{rng: rand.New(rand.NewSource(1)), delay: noDelay}
+	panics := workerPanics.Value()
+
+	// the nil db panics in the transfer, the worker recovers from it and
+	// goes on with the next operation
+	var db *sql.DB
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			bank.recoverPanic(w, func() {
+				bank.moveMoney(context.Background(), db, w)
+			})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the worker doesn't go on after the panic")
+	}
+	if got := workerPanics.Value() - panics; got != 3 {
+		t.Fatalf("got %d panics, want 3", got)
+	}
+
+	ran := false
+	bank.recoverPanic(w, func() { ran = true })
+	if !ran || workerPanics.Value()-panics != 3 {
+		t.Fatal("the operation without panic isn't run or is counted as panic")
+	}
+}
+
+func TestWaitResumedQuits(t *testing.T) {
+	bank := newTestBank(10)
+	bank.Pause()
+	defer bank.Resume()
+
+	quit := make(chan struct{})
+	done := make(chan bool)
+	go func() { done <- bank.waitResumed(context.Background(), quit) }()
+	close(quit)
+	select {
+	case resumed := <-done:
+		if resumed {
+			t.Fatal("the worker resumes though it quits")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the paused worker doesn't quit")
+	}
+}
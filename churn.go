@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// sinkAccountID is the id of the sink account of every accounts table, which
+// keeps the money of the closed accounts. It's created by the first close.
+const sinkAccountID = -1
+
+// errAccountClosed is returned by readBalances if an account of the transfer
+// is closed by the churn.
+var errAccountClosed = errors.New("account closed")
+
+// countMatches returns whether the number of the rows of an accounts table is
+// right, the accounts come and go with AccountChurn.
+func (c *BankCase) countMatches(count, numAccounts int) bool {
+	return c.cfg.AccountChurn > 0 || count == numAccounts
+}
+
+// churnAccount closes a random account, or opens it again if it's closed.
+func (c *BankCase) churnAccount(ctx context.Context, db *sql.DB, w *worker) {
+	i := w.rng.Intn(c.cfg.TableNum)
+	table, id := c.accountsTable(tableIndex(i)), c.accountID(w.rng.Intn(c.cfg.NumAccounts[i]))
+	// only the retryable errors are retried, others are kept in churnErr
+	var (
+		op       string
+		churnErr error
+	)
+	err := RunWithRetry(ctx, c.cfg.RetryLimit, 10*time.Millisecond, func() error {
+		var err error
+		op, err = c.churn(ctx, db, table, id)
+		if IsRetryableTxnError(err) {
+			return err
+		}
+		churnErr = errors.Trace(err)
+		return nil
+	})
+	if err == nil {
+		err = churnErr
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("[%s] churn account %d of %s error %v", c, id, table, err)
+		}
+		return
+	}
+	if op != "" {
+		c.count(accountChurns, op)
+	}
+}
+
+// churn closes account id of table by moving its balance to the sink account
+// and deleting it, or opens it with up to InitialBalance from the sink account
+// if it's closed. It returns the operation, or empty if nothing is done.
+func (c *BankCase) churn(ctx context.Context, db *sql.DB, table string, id int) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	var balance uint64
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("select balance from %s where id = %d for update", table, id)).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var op string
+	if err == nil {
+		op = "close"
+		query := fmt.Sprintf("insert into %s (%s) values %s on duplicate key update balance = balance + %d",
+			table, c.insertColumns(), c.accountValues(sinkAccountID, balance, ""), balance)
+		if _, err = tx.ExecContext(ctx, query); err != nil {
+			return "", err
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("delete from %s where id = %d", table, id)); err != nil {
+			return "", err
+		}
+	} else {
+		var sink uint64
+		err = tx.QueryRowContext(ctx, fmt.Sprintf("select balance from %s where id = %d for update", table, sinkAccountID)).Scan(&sink)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		amount := c.cfg.InitialBalance
+		if sink < amount {
+			amount = sink
+		}
+		if amount == 0 {
+			return "", nil
+		}
+		op = "open"
+		query := fmt.Sprintf("insert into %s (%s) values %s", table, c.insertColumns(), c.accountValues(id, amount, c.accountRemark(id)))
+		if _, err = tx.ExecContext(ctx, query); err != nil {
+			return "", err
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("update %s set balance = balance - %d where id = %d", table, amount, sinkAccountID)); err != nil {
+			return "", err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return op, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// transferWorkers is the dynamic set of the transfer workers without delay,
+// its size is changed by SetConcurrency at run time.
+type transferWorkers struct {
+	mu sync.Mutex
+	// wg tracks the workers spawned, Execute waits for it once spawn is
+	// cleared, so no worker is added while it waits
+	wg sync.WaitGroup
+	// quits are closed to make the workers exit, one for each worker
+	quits []chan struct{}
+	// spawn starts the i-th worker with the seed-th random source which
+	// exits once quit is closed, it's set by Execute while the transfers run
+	// and it's only called with mu held
+	spawn func(i, seed int, quit <-chan struct{})
+	// seeds is the number of the random sources of the workers, every worker
+	// of Execute takes the next one
+	seeds int
+}
+
+// nextSeed returns the index of the random source of a new worker.
+func (t *transferWorkers) nextSeed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nextSeedLocked()
+}
+
+func (t *transferWorkers) nextSeedLocked() int {
+	t.seeds++
+	return t.seeds - 1
+}
+
+// SetConcurrency changes the number of the transfer workers to n, the extra
+// workers exit after their current transfers. It fails if the transfers
+// aren't running.
+func (c *BankCase) SetConcurrency(n int) error {
+	if n <= 0 {
+		return errors.Errorf("concurrency %d must be positive", n)
+	}
+	c.workers.mu.Lock()
+	defer c.workers.mu.Unlock()
+	if c.workers.spawn == nil {
+		return errors.New("the transfers are not running")
+	}
+	for len(c.workers.quits) > n {
+		last := len(c.workers.quits) - 1
+		close(c.workers.quits[last])
+		c.workers.quits = c.workers.quits[:last]
+	}
+	for len(c.workers.quits) < n {
+		quit := make(chan struct{})
+		c.workers.spawn(len(c.workers.quits), c.workers.nextSeedLocked(), quit)
+		c.workers.quits = append(c.workers.quits, quit)
+	}
+	log.Infof("[%s] concurrency is %d", c, n)
+	return nil
+}
+
+// Concurrency returns the number of the transfer workers.
+func (c *BankCase) Concurrency() int {
+	c.workers.mu.Lock()
+	defer c.workers.mu.Unlock()
+	return len(c.workers.quits)
+}
+
+// StartControlServer serves the API to control the bank case on addr, it shuts
+// the server down when ctx is done.
+//
+//	GET /concurrency returns the number of the transfer workers
+//	POST /concurrency?n=N changes it to N
+func StartControlServer(ctx context.Context, addr string, c *BankCase) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/concurrency", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			n, err := strconv.Atoi(r.FormValue("n"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid n: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err = c.SetConcurrency(n); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", c.Concurrency())
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("[bank] control server listens on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("[bank] control server error %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// Chaos DDL operations.
+const (
+	// ChaosDDLColumn adds or drops the column chaos_col
+	ChaosDDLColumn = "column"
+	// ChaosDDLIndex adds or drops the index chaos_idx
+	ChaosDDLIndex = "index"
+)
+
+// chaosColumnPrefix is the prefix of the columns added by chaos DDL, they're
+// ignored by the schema check.
+const chaosColumnPrefix = "chaos_"
+
+// chaosDDL runs a random operation of ChaosDDLOps on a random accounts table
+// every ChaosDDLInterval until the bank case stops. The DDL only touches the
+// columns and indexes the transfers don't use.
+func (c *BankCase) chaosDDL(ctx context.Context, db *sql.DB) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.ChaosDDLInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		table := c.accountsTable(tableIndex(rand.Intn(c.cfg.TableNum)))
+		var add, drop string
+		switch op := c.cfg.ChaosDDLOps[rand.Intn(len(c.cfg.ChaosDDLOps))]; op {
+		case ChaosDDLColumn:
+			add = fmt.Sprintf("alter table %s add column %scol INT NOT NULL DEFAULT 0", table, chaosColumnPrefix)
+			drop = fmt.Sprintf("alter table %s drop column %scol", table, chaosColumnPrefix)
+		case ChaosDDLIndex:
+			add = fmt.Sprintf("alter table %s add index chaos_idx (balance)", table)
+			drop = fmt.Sprintf("alter table %s drop index chaos_idx", table)
+		default:
+			log.Errorf("[%s] unknown chaos DDL %s", c, op)
+			return
+		}
+
+		// add the column or index if it doesn't exist, otherwise drop it
+		start := time.Now()
+		query := add
+		_, err := db.ExecContext(ctx, query)
+		if isMySQLError(err, 1060, 1061) {
+			query = drop
+			_, err = db.ExecContext(ctx, query)
+		}
+		if err != nil {
+			log.Errorf("[%s] chaos DDL %s error %v", c, query, err)
+			continue
+		}
+		log.Infof("[%s] chaos DDL %s, takes %s", c, query, time.Since(start))
+	}
+}
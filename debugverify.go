@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// maxDebugVerifyAccounts is the max number of accounts of a table for
+// DebugVerifyEach, which sums the whole table after every transfer.
+const maxDebugVerifyAccounts = 1000
+
+// verifyTransfer verifies the accounts table id right after the transfers
+// commit. The transfers and their verifies are serialized by debugVerifyMu,
+// so a mismatch is caused by exactly these transfers.
+func (c *BankCase) verifyTransfer(ctx context.Context, db *sql.DB, w *worker, id int, transfers []transferArgs) {
+	err := c.verify(ctx, db, "debug", id, 0)
+	if err == nil {
+		return
+	}
+	if !isMismatch(err) {
+		// the transfers go on, only a mismatch is attributed to them
+		if ctx.Err() == nil {
+			log.Warnf("[%s] debug verify error %v", c, err)
+		}
+		return
+	}
+	moves := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		moves = append(moves, fmt.Sprintf("%d -> %d amount %d", t.from, t.to, t.amount))
+	}
+	c.stop(invariantViolation("transfer %s on %s by %s worker in txn mode %s breaks the invariants: %v",
+		strings.Join(moves, ", "), c.accountsTable(tableIndex(id)), delayModeName(w.delay), metricsTxnMode(w.txnMode), err))
+}
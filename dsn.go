@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// passwordEnv is the environment variable of the database password.
+const passwordEnv = "BANK_DB_PASSWORD"
+
+// Protocols of the database connections.
+const (
+	protocolTCP  = "tcp"
+	protocolUnix = "unix"
+)
+
+// defaultPort is the port of the tcp address without one, which is the
+// default of the MySQL driver.
+const defaultPort = "3306"
+
+// buildDSN returns the DSN of the database. The password is read from pwFile
+// if it's set, otherwise pw is used if it's not empty, otherwise the password
+// is read from the BANK_DB_PASSWORD environment variable. The database is
+// connected by addr for protocol tcp, or by the socket file for protocol unix.
+func buildDSN(user, pw, pwFile, protocol, addr, socket, dbName string) (string, error) {
+	switch {
+	case pwFile != "":
+		b, err := ioutil.ReadFile(pwFile)
+		if err != nil {
+			return "", errors.Annotate(err, "read password file")
+		}
+		pw = strings.TrimRight(string(b), "\r\n")
+	case pw == "":
+		pw = os.Getenv(passwordEnv)
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User, cfg.Passwd, cfg.DBName = user, pw, dbName
+	switch protocol {
+	case protocolTCP:
+		cfg.Net, cfg.Addr = protocolTCP, tcpAddr(addr)
+	case protocolUnix:
+		if socket == "" {
+			return "", errors.Errorf("protocol %s needs the socket file", protocolUnix)
+		}
+		cfg.Net, cfg.Addr = protocolUnix, socket
+	default:
+		return "", errors.Errorf("unknown protocol %s", protocol)
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// tcpAddr returns addr with the IPv6 host bracketed, such as [::1]:4000. The
+// address without port, including a bare or bracketed IPv6 literal, gets
+// defaultPort. The empty address is left to the driver.
+func tcpAddr(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+}
+
+// replaceAddr returns dsn connecting to the tcp address addr instead.
+func replaceAddr(dsn, addr string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	cfg.Net, cfg.Addr = protocolTCP, tcpAddr(addr)
+	return cfg.FormatDSN(), nil
+}
+
+// mergeDSNParams merges params, a query string such as
+// readTimeout=30s&writeTimeout=30s, into the parameters of dsn. A parameter
+// given twice in params is rejected, and the ones of params override those of
+// dsn. The merged DSN is parsed by the driver so the invalid values fail early.
+func mergeDSNParams(dsn, params string) (string, error) {
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return "", errors.Annotate(err, "parse dsn params")
+	}
+	for key, v := range values {
+		if len(v) > 1 {
+			return "", errors.Errorf("dsn param %s is given %d times", key, len(v))
+		}
+	}
+
+	// the parameters follow the first ? after the last /, as the driver parses
+	base, query := dsn, ""
+	slash := strings.LastIndexByte(dsn, '/')
+	if i := strings.IndexByte(dsn[slash+1:], '?'); i >= 0 {
+		base, query = dsn[:slash+1+i], dsn[slash+2+i:]
+	}
+	merged, err := url.ParseQuery(query)
+	if err != nil {
+		return "", errors.Annotate(err, "parse the params of dsn")
+	}
+	for key := range values {
+		if old, ok := merged[key]; ok && old[0] != values.Get(key) {
+			log.Warnf("[bank] dsn param %s=%s overrides %s", key, values.Get(key), old[0])
+		}
+		merged.Set(key, values.Get(key))
+	}
+	dsn = base + "?" + merged.Encode()
+	if _, err = mysql.ParseDSN(dsn); err != nil {
+		return "", errors.Annotate(err, "dsn params")
+	}
+	return dsn, nil
+}
+
+// redactDSN hides the password in dsn so it can be logged.
+func redactDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "<invalid dsn>"
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = "******"
+	}
+	return cfg.FormatDSN()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestTCPAddr(t *testing.T) {
+	for _, tt := range []struct{ addr, want string }{
+		{"", ""},
+		{"127.0.0.1:4000", "127.0.0.1:4000"},
+		{"127.0.0.1", "127.0.0.1:3306"},
+		{"tidb:4000", "tidb:4000"},
+		{"[::1]:4000", "[::1]:4000"},
+		{"[::1]", "[::1]:3306"},
+		{"::1", "[::1]:3306"},
+		{"fe80::1", "[fe80::1]:3306"},
+	} {
+		if got := tcpAddr(tt.addr); got != tt.want {
+			t.Errorf("tcpAddr(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDSN(t *testing.T) {
+	for _, tt := range []struct {
+		name                   string
+		protocol, addr, socket string
+		net, want              string
+		err                    string
+	}{
+		{name: "tcp", protocol: protocolTCP, addr: "127.0.0.1:4000", net: "tcp", want: "127.0.0.1:4000"},
+		{name: "tcp default port", protocol: protocolTCP, addr: "127.0.0.1", net: "tcp", want: "127.0.0.1:3306"},
+		{name: "ipv6", protocol: protocolTCP, addr: "[::1]:4000", net: "tcp", want: "[::1]:4000"},
+		{name: "bare ipv6", protocol: protocolTCP, addr: "::1", net: "tcp", want: "[::1]:3306"},
+		{name: "unix", protocol: protocolUnix, addr: "127.0.0.1:4000", socket: "/tmp/tidb.sock", net: "unix", want: "/tmp/tidb.sock"},
+		{name: "unix without socket", protocol: protocolUnix, err: "needs the socket file"},
+		{name: "unknown protocol", protocol: "udp", addr: "127.0.0.1:4000", err: "unknown protocol udp"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := buildDSN("root", "pw", "", tt.protocol, tt.addr, tt.socket, "test")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want the error %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatalf("parse %s: %v", dsn, err)
+			}
+			if cfg.Net != tt.net || cfg.Addr != tt.want {
+				t.Fatalf("%s connects %s(%s), want %s(%s)", dsn, cfg.Net, cfg.Addr, tt.net, tt.want)
+			}
+			if cfg.User != "root" || cfg.Passwd != "pw" || cfg.DBName != "test" {
+				t.Fatalf("%s has user %s password %s database %s", dsn, cfg.User, cfg.Passwd, cfg.DBName)
+			}
+		})
+	}
+}
+
+func TestReplaceAddr(t *testing.T) {
+	dsn, err := replaceAddr("root@unix(/tmp/tidb.sock)/test", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "root@tcp([::1]:3306)/test"; !strings.HasPrefix(dsn, want) {
+		t.Fatalf("got %s, want %s", dsn, want)
+	}
+}
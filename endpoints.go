@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// openDB opens the database of dsn for cfg with maxIdleConns idle connections.
+// The connections are spread over cfg.Addrs if there are more than one, and
+// live with jitter if ConnLifetimeJitter is set.
+func openDB(dsn string, cfg *Config, maxIdleConns int) (*sql.DB, error) {
+	if len(cfg.Addrs) <= 1 && cfg.ConnLifetimeJitter <= 0 {
+		return OpenDB(dsn, maxIdleConns)
+	}
+	connector, err := newConnector(dsn, cfg.Addrs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cfg.ConnLifetimeJitter > 0 {
+		connector = newJitterConnector(connector, cfg.ConnMaxLifetime, cfg.ConnLifetimeJitter)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxIdleConns(maxIdleConns)
+	log.Infof("DB opens successfully, addresses %v, the connections live for %s with jitter %s", cfg.Addrs, cfg.ConnMaxLifetime, cfg.ConnLifetimeJitter)
+	return db, nil
+}
+
+// newConnector returns the connector of dsn, which round-robins the tcp
+// addresses addrs if there are more than one.
+func newConnector(dsn string, addrs []string) (driver.Connector, error) {
+	if len(addrs) <= 1 {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return mysql.NewConnector(cfg)
+	}
+	c := &roundRobinConnector{addrs: addrs}
+	for _, addr := range addrs {
+		addrDSN, err := replaceAddr(dsn, addr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg, err := mysql.ParseDSN(addrDSN)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		c.connectors = append(c.connectors, connector)
+	}
+	return c, nil
+}
+
+// roundRobinConnector connects the addresses in turn. An address which
+// fails to connect is skipped for the next one, so the run goes on as long as
+// any address is up. The connections opened before an address goes down fail
+// as closed connections, and are replaced on the other addresses.
+type roundRobinConnector struct {
+	addrs      []string
+	connectors []driver.Connector
+	next       uint32
+}
+
+func (c *roundRobinConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := int(atomic.AddUint32(&c.next, 1) - 1)
+	var err error
+	for i := range c.connectors {
+		n := (start + i) % len(c.connectors)
+		var conn driver.Conn
+		if conn, err = c.connectors[n].Connect(ctx); err == nil {
+			addrConnects.Add(c.addrs[n], 1)
+			return conn, nil
+		}
+		addrConnectFailures.Add(c.addrs[n], 1)
+		log.Warnf("[bank] connect to %s error %v, try the next address", c.addrs[n], err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (c *roundRobinConnector) Driver() driver.Driver {
+	return c.connectors[0].Driver()
+}
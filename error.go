@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql/driver"
+
 	"github.com/go-sql-driver/mysql"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
@@ -18,10 +20,76 @@ func IsErrTableNotExists(err error) bool {
 	return isMySQLError(err, tmysql.ErrNoSuchTable)
 }
 
-func isMySQLError(err error, code uint16) bool {
+// IsErrAdminCheck checks whether err is returned by ADMIN CHECK TABLE for
+// inconsistent data and index
+func IsErrAdminCheck(err error) bool {
+	return isMySQLError(err, tmysql.ErrAdminCheckTable)
+}
+
+// IsLockWaitTimeout returns true if error code = 1205
+func IsLockWaitTimeout(err error) bool {
+	return isMySQLError(err, tmysql.ErrLockWaitTimeout)
+}
+
+// IsDeadlock returns true if error code = 1213, the transaction is chosen as
+// the victim of a deadlock
+func IsDeadlock(err error) bool {
+	return isMySQLError(err, tmysql.ErrLockDeadlock)
+}
+
+// IsLockNowait returns true if a locking read with NOWAIT meets a locked row
+func IsLockNowait(err error) bool {
+	return isMySQLError(err, 3572)
+}
+
+// IsRetryableTxnError returns true if the transaction fails for conflicts,
+// retrying it is expected to succeed.
+func IsRetryableTxnError(err error) bool {
+	return IsLockWaitTimeout(err) || isMySQLError(err,
+		// write conflict
+		9007,
+		// write conflict in select for update
+		8002,
+		// transaction retry error
+		8022,
+		// schema changed during the transaction
+		8028,
+		// the row is locked with NOWAIT
+		3572,
+		// deadlock
+		tmysql.ErrLockDeadlock)
+}
+
+// IsConnClosed checks whether err is caused by a closed or broken connection
+func IsConnClosed(err error) bool {
+	switch originError(err) {
+	case driver.ErrBadConn, mysql.ErrInvalidConn:
+		return true
+	}
+	return isMySQLError(err,
+		tmysql.ErrServerShutdown,
+		tmysql.ErrQueryInterrupted,
+		// connection was killed
+		1927)
+}
+
+// IsRetryable returns true if the operation may succeed on retry
+func IsRetryable(err error) bool {
+	return IsRetryableTxnError(err) || IsConnClosed(err)
+}
+
+func isMySQLError(err error, codes ...uint16) bool {
 	err = originError(err)
 	e, ok := err.(*mysql.MySQLError)
-	return ok && e.Number == code
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Number == code {
+			return true
+		}
+	}
+	return false
 }
 
 // originError return original error
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+)
+
+func TestErrorClassification(t *testing.T) {
+	mysqlErr := func(code uint16) error {
+		return &mysql.MySQLError{Number: code, Message: "test"}
+	}
+	tests := []struct {
+		name              string
+		err               error
+		dupEntry          bool
+		lockWaitTimeout   bool
+		connClosed        bool
+		retryable         bool
+		retryableTxnError bool
+	}{
+		{name: "nil"},
+		{name: "other", err: errors.New("other")},
+		{name: "duplicate entry", err: mysqlErr(1062), dupEntry: true},
+		{name: "lock wait timeout", err: mysqlErr(1205), lockWaitTimeout: true, retryable: true, retryableTxnError: true},
+		{name: "deadlock", err: mysqlErr(1213), retryable: true, retryableTxnError: true},
+		{name: "write conflict", err: mysqlErr(9007), retryable: true, retryableTxnError: true},
+		{name: "lock nowait", err: mysqlErr(3572), retryable: true, retryableTxnError: true},
+		{name: "server shutdown", err: mysqlErr(1053), connClosed: true, retryable: true},
+		{name: "query interrupted", err: mysqlErr(1317), connClosed: true, retryable: true},
+		{name: "connection killed", err: mysqlErr(1927), connClosed: true, retryable: true},
+		{name: "bad conn", err: driver.ErrBadConn, connClosed: true, retryable: true},
+		{name: "invalid conn", err: mysql.ErrInvalidConn, connClosed: true, retryable: true},
+		{name: "annotated", err: errors.Annotate(mysqlErr(9007), "commit"), retryable: true, retryableTxnError: true},
+		{name: "traced twice", err: errors.Trace(errors.Annotate(mysqlErr(1062), "insert")), dupEntry: true},
+	}
+	for _, tt := range tests {
+		if got := IsErrDupEntry(tt.err); got != tt.dupEntry {
+			t.Errorf("%s: IsErrDupEntry = %v, want %v", tt.name, got, tt.dupEntry)
+		}
+		if got := IsLockWaitTimeout(tt.err); got != tt.lockWaitTimeout {
+			t.Errorf("%s: IsLockWaitTimeout = %v, want %v", tt.name, got, tt.lockWaitTimeout)
+		}
+		if got := IsConnClosed(tt.err); got != tt.connClosed {
+			t.Errorf("%s: IsConnClosed = %v, want %v", tt.name, got, tt.connClosed)
+		}
+		if got := IsRetryable(tt.err); got != tt.retryable {
+			t.Errorf("%s: IsRetryable = %v, want %v", tt.name, got, tt.retryable)
+		}
+		if got := IsRetryableTxnError(tt.err); got != tt.retryableTxnError {
+			t.Errorf("%s: IsRetryableTxnError = %v, want %v", tt.name, got, tt.retryableTxnError)
+		}
+	}
+}
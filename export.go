@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// The snapshots are exported for the verifies of other bank processes, one
+// process exports the tso of its snapshot to ExportSnapshot every Interval,
+// the others sum the balances as of the tso read from VerifyAtSnapshot.
+
+// exportSnapshot writes the tso of a new snapshot to ExportSnapshot, the file
+// is replaced atomically so the readers never see a partial tso.
+func (c *BankCase) exportSnapshot(ctx context.Context, db *sql.DB) {
+	var tso uint64
+	if err := db.QueryRowContext(ctx, "select @@tidb_current_ts").Scan(&tso); err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("[%s] export snapshot error %v", c, err)
+		}
+		return
+	}
+	file := c.cfg.ExportSnapshot
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		log.Errorf("[%s] export snapshot error %v", c, err)
+		return
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", tso)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Errorf("[%s] export snapshot error %v", c, err)
+		return
+	}
+	log.Infof("[%s] export snapshot tso %d to %s", c, tso, file)
+}
+
+// readSnapshotTSO reads the tso exported to file.
+func readSnapshotTSO(file string) (uint64, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	tso, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return tso, errors.Annotatef(err, "parse the snapshot tso of %s", file)
+}
+
+// verifyAtSnapshot sums the balances of every table as of the tso exported to
+// VerifyAtSnapshot by another bank process.
+func (c *BankCase) verifyAtSnapshot(ctx context.Context, db *sql.DB) error {
+	tso, err := readSnapshotTSO(c.cfg.VerifyAtSnapshot)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < c.cfg.TableNum; i++ {
+		table, numAccounts := c.accountsTable(tableIndex(i)), c.cfg.NumAccounts[i]
+		count, total, err := c.sumAsOf(ctx, db, table, fmt.Sprintf("tidb_parse_tso(%d)", tso))
+		if err != nil {
+			return errors.Annotatef(err, "verify %s at snapshot %d", table, tso)
+		}
+		if check := c.initialSum(numAccounts); !c.countMatches(count, numAccounts) || total.Cmp(check) != 0 {
+			err = invariantViolation("%s at the exported snapshot %d got %d accounts with total %d, want %d accounts with total %d",
+				table, tso, count, total, numAccounts, check)
+			c.stop(err)
+			return err
+		}
+		log.Infof("[%s] verify %s at the exported snapshot %d success", c, table, tso)
+	}
+	return nil
+}
+
+// sumAsOf returns the number of the accounts of table and the sum of their
+// balances as of the timestamp expression asOf.
+func (c *BankCase) sumAsOf(ctx context.Context, db *sql.DB, table, asOf string) (int, *big.Int, error) {
+	var (
+		count int
+		sum   []byte
+	)
+	query := fmt.Sprintf("select count(*), ifnull(sum(balance), 0) from %s as of timestamp %s", table, asOf)
+	if err := db.QueryRowContext(ctx, query).Scan(&count, &sum); err != nil {
+		return 0, nil, err
+	}
+	total, err := parseBigInt(sum)
+	return count, total, errors.Trace(err)
+}
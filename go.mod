@@ -1,13 +1,16 @@
 module github.com/cwen0/bank
 
-go 1.13
+go 1.15
 
 require (
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
-	github.com/juju/errors v0.0.0-20190930114154-d42613fe1ab9 // indirect
-	github.com/ngaut/log v0.0.0-20180314031856-b8e36e7ba5ac // indirect
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/juju/errors v0.0.0-20190930114154-d42613fe1ab9
+	github.com/ngaut/log v0.0.0-20180314031856-b8e36e7ba5ac
 	github.com/pingcap/errors v0.11.4 // indirect
-	github.com/pingcap/parser v3.0.11+incompatible // indirect
+	github.com/pingcap/parser v3.0.11+incompatible
 	github.com/sirupsen/logrus v1.5.0 // indirect
-	golang.org/x/net v0.0.0-20200320220750-118fecf932d8 // indirect
+	go.uber.org/goleak v1.1.10
+	golang.org/x/net v0.0.0-20200320220750-118fecf932d8
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 )
@@ -0,0 +1,33 @@
+package main
+
+import "math/bits"
+
+// Id schemes of the accounts.
+const (
+	// IDSequential numbers the accounts by 0, 1, 2 and so on, the writes may
+	// hotspot a region
+	IDSequential = "sequential"
+	// IDBitReversed numbers the i-th account by the bits of i reversed like
+	// AUTO_RANDOM, the writes spread across the key space
+	IDBitReversed = "bit-reversed"
+)
+
+// accountID returns the id of the i-th account.
+func (c *BankCase) accountID(i int) int {
+	if c.cfg.IDScheme == IDBitReversed {
+		// the sign bit is shifted out, the ids are positive
+		return int(bits.Reverse64(uint64(i)) >> 1)
+	}
+	return i
+}
+
+// idRange returns the bounds of the ids of the lo-th to the hi-th accounts.
+// They bound exactly these accounts only with IDSequential, the ranges are
+// still random with the other schemes.
+func (c *BankCase) idRange(lo, hi int) (int, int) {
+	lo, hi = c.accountID(lo), c.accountID(hi)
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return lo, hi
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ngaut/log"
+)
+
+// keepAlive pings the idle connections of db every interval until ctx is
+// done, so the pool stays warm through the idle windows. The idle
+// connections are taken out of the pool at once to ping each of them, a dead
+// one is discarded and replaced by the driver. At least one connection is
+// pinged every round.
+func keepAlive(ctx context.Context, db *sql.DB, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n := db.Stats().Idle
+		if n < 1 {
+			n = 1
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		conns := make([]*sql.Conn, 0, n)
+		var failed int
+		for i := 0; i < n; i++ {
+			conn, err := db.Conn(pingCtx)
+			if err == nil {
+				conns = append(conns, conn)
+				err = conn.PingContext(pingCtx)
+			}
+			if err != nil {
+				failed++
+				if ctx.Err() == nil {
+					log.Warnf("[bank] keepalive %s connection error %v", name, err)
+				}
+			}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		cancel()
+		keepalivePings.Add(int64(n))
+		keepaliveFailures.Add(int64(failed))
+	}
+}
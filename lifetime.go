@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// newJitterConnector wraps connector so its connections live for lifetime
+// minus a random duration up to jitter each. SetConnMaxLifetime expires the
+// connections opened together at the same time, the whole pool reconnects at
+// once then.
+func newJitterConnector(connector driver.Connector, lifetime, jitter time.Duration) driver.Connector {
+	return &jitterConnector{
+		Connector: connector,
+		lifetime:  lifetime,
+		jitter:    jitter,
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// jitterConnector connects jitterConns.
+type jitterConnector struct {
+	driver.Connector
+	lifetime time.Duration
+	jitter   time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (c *jitterConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	lifetime := c.lifetime - time.Duration(c.rng.Int63n(int64(c.jitter)+1))
+	c.mu.Unlock()
+	return &jitterConn{Conn: conn, expireAt: time.Now().Add(lifetime)}, nil
+}
+
+// jitterConn is a connection which expires at expireAt, it's discarded when
+// it's reused from the pool after then. The other methods are forwarded to
+// the connection of the driver, the optional interfaces it doesn't implement
+// fall back to what database/sql does without them.
+type jitterConn struct {
+	driver.Conn
+	expireAt time.Time
+}
+
+func (c *jitterConn) ResetSession(ctx context.Context) error {
+	if time.Now().After(c.expireAt) {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid keeps the bad connection detection of database/sql, the
+// connection is valid unless the driver tells otherwise.
+func (c *jitterConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *jitterConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *jitterConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *jitterConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *jitterConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+// Ping succeeds if the driver can't ping, as database/sql does.
+func (c *jitterConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *jitterConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// Init methods.
+const (
+	// InitInsert inserts the accounts by batched INSERT statements
+	InitInsert = "insert"
+	// InitLoadData streams the accounts by LOAD DATA LOCAL INFILE
+	InitLoadData = "load-data"
+)
+
+// loadAccounts streams numAccounts accounts into the accounts table by
+// LOAD DATA LOCAL INFILE. It returns an error if the server rejects it or
+// the table doesn't have all the accounts after loading.
+func (c *BankCase) loadAccounts(ctx context.Context, db *sql.DB, index string, numAccounts int) error {
+	table := c.accountsTable(index)
+	handler := "bank_" + table
+	mysql.RegisterReaderHandler(handler, func() io.Reader {
+		r, w := io.Pipe()
+		go func() {
+			bw := bufio.NewWriter(w)
+			for i := 0; i < numAccounts; i++ {
+				id := c.accountID(i)
+				line := fmt.Sprintf("%d\t%d\t%s", id, c.cfg.InitialBalance, c.accountRemark(id))
+				if c.cfg.CompositeKey {
+					line += fmt.Sprintf("\t%d", accountShard(id))
+				}
+				if _, err := fmt.Fprintln(bw, line); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			w.CloseWithError(bw.Flush())
+		}()
+		return r
+	})
+	defer mysql.DeregisterReaderHandler(handler)
+
+	start := time.Now()
+	// the duplicate rows are skipped by default for LOCAL, REPLACE overwrites them
+	var replace string
+	if c.cfg.InitUpsert {
+		replace = "REPLACE "
+	}
+	query := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' %sINTO TABLE %s (%s)", handler, replace, table, c.insertColumns())
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return errors.Annotatef(err, "load data into %s", table)
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf("select count(*) from %s", table)).Scan(&count); err != nil {
+		return errors.Trace(err)
+	}
+	if count != numAccounts {
+		return errors.Errorf("load %d accounts into %s, want %d", count, table, numAccounts)
+	}
+	log.Infof("[%s] load %d accounts into %s, takes %s", c, numAccounts, table, time.Since(start))
+	return nil
+}
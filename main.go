@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/juju/errors"
 	"github.com/ngaut/log"
 )
 
@@ -16,68 +19,160 @@ var defaultPushMetricsInterval = 15 * time.Second
 
 var (
 	dbName      = flag.String("db", "test", "database name")
-	pw          = flag.String("pw", "", "database password")
+	pw          = flag.String("pw", "", "database password, read from the "+passwordEnv+" environment variable if empty")
 	user        = flag.String("user", "root", "database user")
-	accounts    = flag.Int("accounts", 1000000, "the number of accounts")
+	accounts    = flag.String("accounts", "1000000", "the number of accounts, or a comma separated list of the number of each table")
 	interval    = flag.Duration("interval", 2*time.Second, "the interval")
 	tables      = flag.Int("tables", 1, "the number of the tables")
 	concurrency = flag.Int("concurrency", 200, "concurrency worker count")
 	retryLimit  = flag.Int("retry-limit", 200, "retry count")
 	longTxn     = flag.Bool("long-txn", true, "enable long-term transactions")
 	pessimistic = flag.Bool("pessimistic", false, "use pessimistic transaction")
-	dbAddr      = flag.String("addr", "", "the address of db")
+	dbAddr      = flag.String("addr", "", "the address of db, IPv6 hosts need brackets with the port, such as [::1]:4000, the connections round-robin comma-separated addresses and skip the ones down")
+
+	minDelay          = flag.Duration("min-delay", 10*time.Minute-10*time.Second, "the min delay of long-term transactions")
+	maxDelay          = flag.Duration("max-delay", 10*time.Minute+10*time.Second, "the max delay of long-term transactions")
+	amountMin         = flag.Int("amount-min", 0, "the min amount of a transfer")
+	amountMax         = flag.Int("amount-max", 998, "the max amount of a transfer")
+	amountDist        = flag.String("amount-dist", AmountUniform, "the distribution of transfer amounts, uniform or normal")
+	seed              = flag.Int64("seed", 0, "the seed of random transfers, use the current time if 0")
+	prepared          = flag.Bool("prepared", false, "use prepared statements in transfers")
+	pessimisticRatio  = flag.Float64("pessimistic-ratio", -1, "the ratio of workers using pessimistic transactions on TiDB, use the global txn mode if negative")
+	savepoint         = flag.Bool("savepoint", false, "enable transactions which roll back to a savepoint")
+	connectTimeout    = flag.Duration("connect-timeout", time.Minute, "how long to wait for the database to be connectable at startup")
+	maxOpenConns      = flag.Int("max-open-conns", 0, "the max open connections of the pool, unlimited if 0")
+	maxIdleConns      = flag.Int("max-idle-conns", 0, "the max idle connections of the pool, use concurrency if 0")
+	connLifetime      = flag.Duration("conn-max-lifetime", 0, "the max lifetime of pooled connections, unlimited if 0")
+	lifetimeJitter    = flag.Duration("conn-lifetime-jitter", 0, "shorten the lifetime of every connection by a random duration up to it, so the connections don't expire and reconnect at once, needs -conn-max-lifetime")
+	trackUpdate       = flag.Bool("track-updated-at", false, "store the tso of the last transfer in accounts and verify it against the record table")
+	mode              = flag.String("mode", modeInitAndRun, "run mode, init, run, init+run, verify-once, dump-records, cleanup, snapshot-diff, replay-verify or probe")
+	dumpFile          = flag.String("dump-file", "-", "the file to dump the record table to in dump-records mode, - for stdout")
+	dumpFormat        = flag.String("dump-format", dumpCSV, "the format to dump the record table, csv or json")
+	snapshotDiff      = flag.String("snapshot-diff", "", "the old and new state snapshot files separated by comma to diff in snapshot-diff mode")
+	statusAddr        = flag.String("status-addr", "", "the address to serve /healthz, /readyz and /debug/vars, disabled if empty")
+	verifyMode        = flag.String("verify-mode", VerifyFullSum, "verify mode, full-sum or range-sample")
+	verifySample      = flag.Int("verify-sample-size", 1000, "the number of accounts sampled by each verify in range-sample mode")
+	verifyTimeout     = flag.Duration("verify-timeout", 6*time.Hour, "how long verify failures are tolerated before exiting")
+	verifyConc        = flag.Int("verify-concurrency", 1, "the number of concurrent verify loops")
+	verifyRate        = flag.Float64("verify-rate", 0, "the max verify rounds per second of all verify loops, unlimited if 0")
+	withIndex         = flag.Bool("with-index", false, "add a secondary index on balance to the accounts tables, and verify it's consistent with the rows")
+	generatedColumn   = flag.Bool("generated-column", false, "add a stored generated column and an index on it to the accounts tables, and verify them")
+	unsignedBalance   = flag.Bool("unsigned-balance", false, "use BIGINT UNSIGNED balances")
+	initialBalance    = flag.Uint64("initial-balance", 1000, "the initial balance of every account")
+	chaosKillConn     = flag.Float64("chaos-kill-conn-ratio", 0, "the ratio of transfers whose connections are killed before commit")
+	initConcurrency   = flag.Int("init-concurrency", 0, "the number of workers inserting the accounts, use concurrency if 0")
+	verifyDistinct    = flag.Bool("verify-distinct", false, "verify no account id is duplicated")
+	pwFile            = flag.String("pw-file", "", "the file to read the database password from, it takes precedence over -pw and the "+passwordEnv+" environment variable")
+	dsnParams         = flag.String("dsn-params", "", "the parameters of the driver merged into the DSN, such as readTimeout=30s&writeTimeout=30s")
+	dsn               = flag.String("dsn", "", "the full DSN of the database, it overrides -user, -pw, -pw-file, -protocol, -addr, -socket and -db")
+	protocol          = flag.String("protocol", protocolTCP, "the protocol to connect to the database, tcp by -addr or unix by -socket")
+	socket            = flag.String("socket", "", "the unix socket file of the database for -protocol unix")
+	recordRetention   = flag.Int("record-retention", 0, "the number of the latest rows kept in the record table, keep all rows if 0")
+	disableRecord     = flag.Bool("disable-record", false, "don't insert transfers into the record table")
+	failFast          = flag.Bool("fail-fast", false, "stop on the first verify error instead of tolerating errors for -verify-timeout, it may false-positive on transient errors of long-term transactions")
+	tablePrefix       = flag.String("table-prefix", "", "the prefix of the names of the tables")
+	warmup            = flag.Duration("warmup", 0, "how long the transfers run before the metrics are recorded")
+	initMethod        = flag.String("init-method", InitInsert, "how the accounts are inserted, insert or load-data, load-data falls back to insert if the server rejects it")
+	microVerify       = flag.Int("micro-verify-every", 0, "re-read the accounts of every N-th transfer of each worker before commit, disabled if 0")
+	reconcileTables   = flag.String("reconcile-tables", ReconcileWarn, "how to handle the accounts tables beyond -tables left by former runs, warn, verify or drop")
+	chaosDDL          = flag.String("chaos-ddl", "", "the comma separated DDL operations run during transfers, column or index, disabled if empty")
+	chaosDDLInterval  = flag.Duration("chaos-ddl-interval", 30*time.Second, "the interval of the chaos DDL operations")
+	verifyStartOnly   = flag.Bool("verify-on-start-only", false, "verify the tables before and after the transfers instead of during them")
+	verifyLostUpdate  = flag.Bool("verify-lost-update", false, "replay the record table to verify no transfer reads a stale balance")
+	readRatio         = flag.Float64("read-ratio", 0, "the ratio of the operations which are read-only queries instead of transfers")
+	rateLimit         = flag.Float64("rate-limit", 0, "the max transfers per second of all workers, unlimited if 0")
+	reportFile        = flag.String("report-file", "", "the file to write the JSON summary of the run to on exit, disabled if empty")
+	initUpsert        = flag.Bool("init-upsert", false, "overwrite the balances of the existing accounts with the initial balance during init, unlike the default INSERT IGNORE which keeps them")
+	snapshotInterval  = flag.Duration("state-snapshot-interval", 0, "the interval to snapshot the balances of all accounts to -state-snapshot-dir for debugging, disabled if 0, only for small tables")
+	snapshotDir       = flag.String("state-snapshot-dir", ".", "the directory of the state snapshots")
+	tableCharset      = flag.String("table-charset", "", "the charset of the accounts tables, the server default if empty")
+	tableCollation    = flag.String("table-collation", "", "the collation of the accounts tables, such as utf8mb4_bin or utf8mb4_general_ci, the server default if empty")
+	multibyteRemark   = flag.Bool("multibyte-remark", false, "fill the remarks with multi-byte UTF-8 characters and verify they round-trip, needs re-initialized tables and -table-charset utf8mb4")
+	postRunVerify     = flag.Duration("post-run-verify-window", 0, "keep verifying for the duration after the transfers end, the last verify must pass, disabled if 0")
+	lockMode          = flag.String("lock-mode", LockForUpdate, "the lock clause of the select of transfers, for-update, for-update-nowait which fails at once on locked rows and retries, or none which relies on the optimistic transactions of TiDB to detect the write conflicts at commit")
+	lockOrder         = flag.String("lock-order", LockOrderNone, "the order to lock the accounts of transfers, none locks both in one select, from-to and ascending lock them one by one")
+	logDeadlock       = flag.Bool("log-deadlock", false, "log the accounts of the transfers which deadlock")
+	pinConn           = flag.Bool("pin-conn", false, "every worker runs its transfers on a dedicated connection of the pool for its lifetime, so the session variables persist")
+	recordFanout      = flag.Int("record-fanout", 1, "the number of the record rows every transfer inserts to amplify the writes, distinguished by the seq column")
+	staleRead         = flag.Duration("stale-read", 0, "also verify the balances as of the duration ago by the stale read of TiDB, disabled if 0")
+	txnSize           = flag.Int("txn-size", 1, "the number of the transfers in a transaction, large ones test the transaction size limits")
+	verifyTSOOrder    = flag.Bool("verify-tso-order", false, "replay the record table in tso order to check the balances of every account progress in tso order, only on TiDB with optimistic transactions")
+	noDrop            = flag.Bool("no-drop", false, "refuse to drop the tables whose accounts mismatch -accounts during init, repair them in place with -init-upsert instead")
+	onMismatch        = flag.String("on-mismatch", OnMismatchFatal, "the action on invariant violations, fatal, pause which dumps the tables to -state-snapshot-dir and waits for a signal to exit, or continue which logs them and keeps running")
+	verifyAddr        = flag.String("verify-addr", "", "the address of a replica to verify on while the transfers run on -addr, combine with -post-run-verify-window for the replica lag")
+	verifyTiFlash     = flag.Bool("verify-tiflash", false, "also verify the sums of the balances on TiFlash equal the sums on TiKV, the tables without TiFlash replicas are skipped")
+	progressInterval  = flag.Duration("init-progress-interval", 10*time.Second, "the interval to log how many accounts are inserted during init, disabled if 0")
+	clusteredIndex    = flag.String("clustered-index", "", "the clustering of the primary keys of the accounts tables on TiDB, empty for the default, clustered or nonclustered")
+	compositeKey      = flag.Bool("composite-key", false, "key the accounts by (id, shard) instead of id")
+	writeSkewPairs    = flag.Int("write-skew-pairs", 0, "the number of the account pairs of the write skew test, two workers withdraw from each pair only if it has enough money in total, disabled if 0")
+	writeSkewLock     = flag.Bool("write-skew-lock", false, "lock the pairs of the write skew test by -lock-mode which must prevent the write skews, otherwise they're only counted")
+	analyzeAfterInit  = flag.Bool("analyze-after-init", false, "analyze the tables after init so the statistics are fresh")
+	schemaFile        = flag.String("schema-file", "", "the file of the template of the DDL creating the accounts tables, {{.Table}} is the table name, the tables need the id, balance and remark columns, it conflicts with -track-updated-at, -composite-key, -generated-column and -with-index")
+	recordAsync       = flag.Bool("record-async", false, "insert the records in batches after the transfers commit instead of in the transfers, it's faster but the record table lags behind the accounts tables")
+	maxDrift          = flag.Int64("max-drift", 0, "stop once the balances of a table drift by more than it with -on-mismatch continue, disabled if 0")
+	initLogEvery      = flag.Int("init-log-every", 100, "log every so many batches of accounts inserted during init, disabled if 0")
+	controlAddr       = flag.String("control-addr", "", "the address of the control server to change the concurrency at run time by POST /concurrency?n=N, disabled if empty")
+	snapshotStable    = flag.Duration("verify-snapshot-stability", 0, "sum the balances again after the duration in the verify transactions to check they read a stable snapshot, only with -verify-mode full-sum, disabled if 0")
+	idScheme          = flag.String("id-scheme", IDSequential, "how the accounts are numbered, sequential, or bit-reversed which spreads the writes like AUTO_RANDOM")
+	exportSnapshot    = flag.String("export-snapshot", "", "the file to export the tso of a snapshot to every -interval for the verifies of other bank processes, only on TiDB")
+	verifyAtSnapshot  = flag.String("verify-at-snapshot", "", "the file of the tso exported by -export-snapshot of another bank process, verify the balances as of it every -interval and in verify-once mode, only on TiDB")
+	accountChurn      = flag.Float64("account-churn", 0, "the ratio of the operations which close a random account by moving its money to a sink account, or open it again with the money of the sink account")
+	verifyHint        = flag.String("verify-hint", "", "the optimizer hints of the verify sums without /*+ and */, like read_from_storage(tikv[accounts])")
+	verifyRetry       = flag.Int("verify-retry", 3, "the max number of the immediate retries of a verify failing for a transient error like a broken connection, the mismatches are never retried")
+	debugVerifyEach   = flag.Bool("debug-verify-each", false, "verify the table after every transfer, the transfers are serialized to attribute a mismatch to the exact one, for tiny tables only")
+	poolStatsInterval = flag.Duration("pool-stats-interval", 0, "the interval to log the stats of the connection pools, disabled if 0")
+	verifyLogFile     = flag.String("verify-log", "", "the csv file to append the timestamp, tso, table, computed and expected sums of every verify to, disabled if empty")
+	keepaliveInterval = flag.Duration("keepalive-interval", 0, "the interval to ping the idle connections to keep the pool warm, disabled if 0")
+	slowTxn           = flag.Duration("slow-txn-threshold", time.Second, "log the transfers taking longer than it, disabled if 0")
 )
 
 var (
-	defaultVerifyTimeout = 6 * time.Hour
-	remark               = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXVZabcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXVZlkjsanksqiszndqpijdslnnq"
+	remark = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXVZabcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXVZlkjsanksqiszndqpijdslnnq"
 )
 var (
 	TiDBDatabase = true
 )
 
+// parseAccounts parses the comma separated number of accounts of each table,
+// a single number is shared by all tables.
+func parseAccounts(s string, tables int) ([]int, error) {
+	var nums []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// a transfer needs two different accounts
+		if n < 2 {
+			return nil, errors.Errorf("%d accounts are too few", n)
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) != 1 && len(nums) != tables {
+		return nil, errors.Errorf("got %d numbers for %d tables", len(nums), tables)
+	}
+	return nums, nil
+}
+
 func main() {
 	flag.Parse()
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	dbDSN := fmt.Sprintf("%s:%s@tcp(%s)/%s", *user, *pw, *dbAddr, *dbName)
-	log.Info(dbDSN)
-	db, err := OpenDB(dbDSN, 1)
-	if err != nil {
-		log.Fatalf("[bank] create dlog error %v", err)
-	}
-	_, err = db.Exec("select tidb_version();")
+	numAccounts, err := parseAccounts(*accounts, *tables)
 	if err != nil {
-		TiDBDatabase = false
-		log.Info("[bank] select tidb_version(): %v", err)
+		log.Fatalf("[bank] invalid -accounts %s: %v", *accounts, err)
 	}
-
-	if TiDBDatabase {
-		if *pessimistic {
-			_, err = db.Exec("set @@global.tidb_txn_mode = 'pessimistic';")
-			if err != nil {
-				log.Fatalf("[bank] set pessimistic failed: %v", err)
-			}
-		}
-
-		var txnMode string
-		if err = db.QueryRow("select @@tidb_txn_mode").Scan(&txnMode); err == nil {
-			log.Infof("[bank] Current txmode: %v", txnMode)
+	var chaosDDLOps []string
+	if *chaosDDL != "" {
+		for _, op := range strings.Split(*chaosDDL, ",") {
+			chaosDDLOps = append(chaosDDLOps, strings.TrimSpace(op))
 		}
 	}
 
-	err = db.Close()
-	if err != nil {
-		log.Fatalf("[bank] fail to close set txmode conn", err)
+	var snapshotDiffFiles []string
+	if *snapshotDiff != "" {
+		snapshotDiffFiles = strings.Split(*snapshotDiff, ",")
 	}
 
-	time.Sleep(5 * time.Second)
-
-	db, err = OpenDB(dbDSN, *concurrency)
-	if err != nil {
-		log.Fatalf("[bank] create dlog error %v", err)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc,
@@ -89,22 +184,138 @@ func main() {
 		sig := <-sc
 		log.Infof("[bank] Got signal [%s] to exist.", sig)
 		cancel()
-		os.Exit(0)
 	}()
 
 	cfg := Config{
-		NumAccounts:   *accounts,
-		Interval:      *interval,
-		TableNum:      *tables,
-		Concurrency:   *concurrency,
-		EnableLongTxn: *longTxn,
+		NumAccounts:             numAccounts,
+		Interval:                *interval,
+		TableNum:                *tables,
+		Concurrency:             *concurrency,
+		EnableLongTxn:           *longTxn,
+		VerifyTimeout:           *verifyTimeout,
+		MinDelay:                *minDelay,
+		MaxDelay:                *maxDelay,
+		Prepared:                *prepared,
+		EnableSavepoint:         *savepoint,
+		VerifyMode:              *verifyMode,
+		VerifySampleSize:        *verifySample,
+		TrackUpdatedAt:          *trackUpdate,
+		PessimisticRatio:        *pessimisticRatio,
+		AmountMin:               *amountMin,
+		AmountMax:               *amountMax,
+		AmountDist:              *amountDist,
+		RetryLimit:              *retryLimit,
+		Seed:                    *seed,
+		SlowTxnThreshold:        *slowTxn,
+		OnMismatch:              *onMismatch,
+		MaxDrift:                *maxDrift,
+		DebugVerifyEach:         *debugVerifyEach,
+		PoolStatsInterval:       *poolStatsInterval,
+		NoDrop:                  *noDrop,
+		VerifyTSOOrder:          *verifyTSOOrder,
+		TxnSize:                 *txnSize,
+		StaleRead:               *staleRead,
+		WriteSkewPairs:          *writeSkewPairs,
+		WriteSkewLock:           *writeSkewLock,
+		ClusteredIndex:          *clusteredIndex,
+		CompositeKey:            *compositeKey,
+		IDScheme:                *idScheme,
+		VerifyTiFlash:           *verifyTiFlash,
+		VerifyHint:              *verifyHint,
+		VerifyRetry:             *verifyRetry,
+		ExportSnapshot:          *exportSnapshot,
+		VerifyAtSnapshot:        *verifyAtSnapshot,
+		VerifySnapshotStability: *snapshotStable,
+		RecordFanout:            *recordFanout,
+		RecordAsync:             *recordAsync,
+		AccountChurn:            *accountChurn,
+		PinConn:                 *pinConn,
+		LockOrder:               *lockOrder,
+		LogDeadlock:             *logDeadlock,
+		LockMode:                *lockMode,
+		PostRunVerifyWindow:     *postRunVerify,
+		TableCharset:            *tableCharset,
+		TableCollation:          *tableCollation,
+		MultibyteRemark:         *multibyteRemark,
+		StateSnapshotInterval:   *snapshotInterval,
+		StateSnapshotDir:        *snapshotDir,
+		InitUpsert:              *initUpsert,
+		ReportFile:              *reportFile,
+		VerifyLog:               *verifyLogFile,
+		KeepaliveInterval:       *keepaliveInterval,
+		RateLimit:               *rateLimit,
+		ReadRatio:               *readRatio,
+		VerifyLostUpdate:        *verifyLostUpdate,
+		VerifyOnStartOnly:       *verifyStartOnly,
+		ChaosDDLOps:             chaosDDLOps,
+		ChaosDDLInterval:        *chaosDDLInterval,
+		ReconcileTables:         *reconcileTables,
+		MicroVerifyEvery:        *microVerify,
+		InitMethod:              *initMethod,
+		Warmup:                  *warmup,
+		TablePrefix:             *tablePrefix,
+		FailFast:                *failFast,
+		DisableRecord:           *disableRecord,
+		RecordRetention:         *recordRetention,
+		VerifyDistinct:          *verifyDistinct,
+		InitConcurrency:         *initConcurrency,
+		AnalyzeAfterInit:        *analyzeAfterInit,
+		InitLogEvery:            *initLogEvery,
+		InitProgressInterval:    *progressInterval,
+		ChaosKillConnRatio:      *chaosKillConn,
+		UnsignedBalance:         *unsignedBalance,
+		InitialBalance:          *initialBalance,
+		GeneratedColumn:         *generatedColumn,
+		WithIndex:               *withIndex,
+		VerifyConcurrency:       *verifyConc,
+		VerifyRate:              *verifyRate,
+		Mode:                    *mode,
+		ConnectTimeout:          *connectTimeout,
+		Pessimistic:             *pessimistic,
+		MaxOpenConns:            *maxOpenConns,
+		MaxIdleConns:            *maxIdleConns,
+		ConnMaxLifetime:         *connLifetime,
+		ConnLifetimeJitter:      *lifetimeJitter,
+		StatusAddr:              *statusAddr,
+		VerifyAddr:              *verifyAddr,
+		ControlAddr:             *controlAddr,
+		DumpFile:                *dumpFile,
+		DumpFormat:              *dumpFormat,
+		SnapshotDiff:            snapshotDiffFiles,
 	}
-	bank := NewBankCase(&cfg)
-	if err := bank.Initialize(ctx, db); err != nil {
-		log.Fatalf("[bank] initial failed %v", err)
+
+	if *schemaFile != "" {
+		b, err := ioutil.ReadFile(*schemaFile)
+		if err != nil {
+			log.Fatalf("[bank] read schema file %s: %v", *schemaFile, err)
+		}
+		cfg.AccountsDDL = string(b)
 	}
 
-	if err := bank.Execute(ctx, db); err != nil {
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf("[bank] %v", err)
+	}
+
+	addrs := strings.Split(*dbAddr, ",")
+	if len(addrs) > 1 {
+		if *dsn != "" || *protocol != protocolTCP {
+			log.Fatalf("[bank] multiple -addr need -protocol %s and conflict with -dsn", protocolTCP)
+		}
+		cfg.Addrs = addrs
+	}
+	dbDSN := *dsn
+	if dbDSN == "" {
+		if dbDSN, err = buildDSN(*user, *pw, *pwFile, *protocol, addrs[0], *socket, *dbName); err != nil {
+			log.Fatalf("[bank] %v", err)
+		}
+	}
+	if *dsnParams != "" {
+		if dbDSN, err = mergeDSNParams(dbDSN, *dsnParams); err != nil {
+			log.Fatalf("[bank] %v", err)
+		}
+	}
+	log.Info(redactDSN(dbDSN))
+	if err := Run(ctx, cfg, dbDSN); err != nil {
 		log.Fatalf("[bank] returwith error %v", err)
 	}
 }
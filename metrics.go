@@ -0,0 +1,196 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+)
+
+// The metrics are published by expvar, they are served on /debug/vars of the
+// status server. The transaction counters are keyed by the txn mode.
+var (
+	txnCommitted      = expvar.NewMap("bank_txn_committed")
+	txnFailed         = expvar.NewMap("bank_txn_failed")
+	txnRetryableError = expvar.NewMap("bank_txn_retryable_errors")
+	// txnChaosKilled counts the transactions whose connections are killed by chaos
+	txnChaosKilled = expvar.NewMap("bank_txn_chaos_killed")
+	// txnLockNowait counts the transactions meeting locked rows with NOWAIT, they're retried
+	txnLockNowait = expvar.NewMap("bank_txn_lock_nowait")
+	// txnDeadlock counts the transactions chosen as deadlock victims, they're retried
+	txnDeadlock = expvar.NewMap("bank_txn_deadlock")
+	// tsoSpread is how many milliseconds the snapshot of each verifier is
+	// behind the latest transfer, keyed by the verifier. It's only set on TiDB.
+	tsoSpread = expvar.NewMap("bank_tso_spread_ms")
+	// readQueries and readFailed count the read-only queries keyed by the query kind
+	readQueries = expvar.NewMap("bank_read_queries")
+	readFailed  = expvar.NewMap("bank_read_failed")
+	// txnAttempts and insertAttempts are the distributions of the attempts of
+	// the committed transfers and the init inserts, keyed by the attempts
+	txnAttempts    = expvar.NewMap("bank_txn_attempts")
+	insertAttempts = expvar.NewMap("bank_insert_attempts")
+	// invariantViolations counts the invariant violations the bank case
+	// continues on for OnMismatchContinue
+	invariantViolations = expvar.NewInt("bank_invariant_violations")
+	// balanceDrift is how much more money each accounts table has than it
+	// should at the last verify, keyed by the table
+	balanceDrift = expvar.NewMap("bank_balance_drift")
+	// accountChurns counts the accounts closed and opened by the churn, keyed by the operation
+	accountChurns = expvar.NewMap("bank_account_churns")
+	// initAccounts and initSeconds are the number of the accounts initialized
+	// and how long it takes, keyed by the accounts table
+	initAccounts = expvar.NewMap("bank_init_accounts")
+	initSeconds  = expvar.NewMap("bank_init_seconds")
+	// addrConnects and addrConnectFailures count the connections opened and
+	// failed to open on each address for multiple -addr
+	addrConnects        = expvar.NewMap("bank_addr_connects")
+	addrConnectFailures = expvar.NewMap("bank_addr_connect_failures")
+	// keepalivePings and keepaliveFailures count the idle connections pinged
+	// by -keepalive-interval and the ones which fail
+	keepalivePings    = expvar.NewInt("bank_keepalive_pings")
+	keepaliveFailures = expvar.NewInt("bank_keepalive_failures")
+	// workerPanics counts the panics of the transfer workers, they're recovered
+	workerPanics = expvar.NewInt("bank_worker_panics")
+	// writeSkews counts the write skews seen without WriteSkewLock, keyed by the pair
+	writeSkews = expvar.NewMap("bank_write_skews")
+	// txnLatency is the latency histogram of the committed transfers, the
+	// long-term transactions are not counted
+	txnLatency = &latencyHistogram{}
+)
+
+func init() {
+	expvar.Publish("bank_txn_latency_ms", expvar.Func(func() interface{} {
+		return txnLatency.percentiles()
+	}))
+}
+
+// latencyBuckets is the number of the buckets of latencyHistogram, the i-th
+// bucket counts the latencies in [2^(i-1), 2^i) milliseconds.
+const latencyBuckets = 24
+
+// latencyHistogram counts latencies in exponential buckets.
+type latencyHistogram struct {
+	buckets [latencyBuckets]int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := bits.Len64(uint64(d / time.Millisecond))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddInt64(&h.buckets[i], 1)
+}
+
+// percentile returns the upper bound in milliseconds of the bucket which the
+// p-th percentile falls in, or 0 if nothing is observed.
+func (h *latencyHistogram) percentile(p float64) int64 {
+	var (
+		counts [latencyBuckets]int64
+		total  int64
+	)
+	for i := range h.buckets {
+		counts[i] = atomic.LoadInt64(&h.buckets[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	var acc int64
+	for i, n := range counts {
+		acc += n
+		if acc >= rank {
+			return 1 << uint(i)
+		}
+	}
+	return 1 << uint(latencyBuckets-1)
+}
+
+func (h *latencyHistogram) percentiles() map[string]int64 {
+	return map[string]int64{
+		"p50":  h.percentile(50),
+		"p90":  h.percentile(90),
+		"p99":  h.percentile(99),
+		"p999": h.percentile(99.9),
+	}
+}
+
+// maxAttemptsKey is the largest key of the attempt distributions, the more
+// attempts are counted in it.
+const maxAttemptsKey = 10
+
+// attemptsKey returns the key of attempts in the attempt distributions.
+func attemptsKey(attempts int) string {
+	if attempts >= maxAttemptsKey {
+		return fmt.Sprintf(">=%d", maxAttemptsKey)
+	}
+	return strconv.Itoa(attempts)
+}
+
+// sumMap returns the sum of the counters of m.
+func sumMap(m *expvar.Map) int64 {
+	var sum int64
+	m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			sum += v.Value()
+		}
+	})
+	return sum
+}
+
+// tsoPhysicalShift is the number of the logical bits of a TiDB tso.
+const tsoPhysicalShift = 18
+
+// observeWriteTSO records tso of a committed transfer if it's the latest one.
+func (c *BankCase) observeWriteTSO(tso uint64) {
+	for {
+		last := atomic.LoadUint64(&c.lastWriteTSO)
+		if tso <= last || atomic.CompareAndSwapUint64(&c.lastWriteTSO, last, tso) {
+			return
+		}
+	}
+}
+
+// observeTSOSpread sets the gauge of how far the snapshot of the verifier at
+// tso is behind the latest transfer.
+func (c *BankCase) observeTSOSpread(verifier string, tso uint64) {
+	var spread int64
+	if last := atomic.LoadUint64(&c.lastWriteTSO); last > tso {
+		spread = int64(last>>tsoPhysicalShift) - int64(tso>>tsoPhysicalShift)
+	}
+	v := new(expvar.Int)
+	v.Set(spread)
+	tsoSpread.Set(verifier, v)
+}
+
+// metricsTxnMode returns the key of txnMode in the transaction counters.
+func metricsTxnMode(txnMode string) string {
+	if txnMode == "" {
+		return "default"
+	}
+	return txnMode
+}
+
+// countTxn increases the transaction counter m of txnMode, the transactions
+// are not counted during the warmup.
+func (c *BankCase) countTxn(m *expvar.Map, txnMode string) {
+	c.count(m, metricsTxnMode(txnMode))
+}
+
+// count increases the counter m of key unless it's during the warmup.
+func (c *BankCase) count(m *expvar.Map, key string) {
+	if atomic.LoadInt32(&c.warmedUp) == 0 {
+		return
+	}
+	m.Add(key, 1)
+}
+
+func logMetrics(c *BankCase) {
+	log.Infof("[%s] transactions committed %s, failed %s, retryable errors %s, chaos killed %s, lock nowait %s, deadlocks %s, attempts %s, tso spread ms %s, reads %s, failed reads %s, write skews %s, worker panics %s",
+		c, txnCommitted, txnFailed, txnRetryableError, txnChaosKilled, txnLockNowait, txnDeadlock, txnAttempts, tsoSpread, readQueries, readFailed, writeSkews, workerPanics)
+}
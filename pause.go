@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// Pause pauses the transfers and reads of the workers, verify keeps running.
+// The transactions in flight, including the long-term ones, still finish.
+func (c *BankCase) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh == nil {
+		c.resumeCh = make(chan struct{})
+		log.Infof("[%s] pause the workload, the transactions in flight still finish", c)
+	}
+}
+
+// Resume resumes the workload paused by Pause.
+func (c *BankCase) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumeCh != nil {
+		close(c.resumeCh)
+		c.resumeCh = nil
+		log.Infof("[%s] resume the workload", c)
+	}
+}
+
+// waitResumed blocks while the workload is paused, it returns false if ctx is
+// done, the bank case stops or quit of the worker is closed. The nil quit
+// never closes.
+func (c *BankCase) waitResumed(ctx context.Context, quit <-chan struct{}) bool {
+	c.pauseMu.Lock()
+	resumeCh := c.resumeCh
+	c.pauseMu.Unlock()
+	if resumeCh == nil {
+		return true
+	}
+	select {
+	case <-resumeCh:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.stopCh:
+		return false
+	case <-quit:
+		return false
+	}
+}
+
+// handlePauseSignals pauses the workload on SIGUSR1 and resumes it on SIGUSR2
+// until ctx is done.
+func handlePauseSignals(ctx context.Context, c *BankCase) {
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sc)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sc:
+			if sig == syscall.SIGUSR1 {
+				c.Pause()
+			} else {
+				c.Resume()
+			}
+		}
+	}
+}
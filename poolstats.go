@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"time"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// poolStats are the stats of the connection pools, keyed by the pool and the stat.
+var poolStats = expvar.NewMap("bank_pool_stats")
+
+// logPoolStats logs and exports the stats of the connection pools every
+// PoolStatsInterval until ctx or done is done. The verify pool is skipped if
+// it's the transfer pool.
+func (c *BankCase) logPoolStats(ctx context.Context, db *sql.DB, done <-chan struct{}) {
+	pools := map[string]*sql.DB{"transfer": db}
+	if c.verifyDB != nil && c.verifyDB != db {
+		pools["verify"] = c.verifyDB
+	}
+	ticker := time.NewTicker(c.cfg.PoolStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for name, pool := range pools {
+			s := pool.Stats()
+			log.Infof("[%s] %s pool open %d, in use %d, idle %d, wait count %d, wait duration %s, max idle closed %d, max lifetime closed %d",
+				c, name, s.OpenConnections, s.InUse, s.Idle, s.WaitCount, s.WaitDuration, s.MaxIdleClosed, s.MaxLifetimeClosed)
+			setPoolStat(name, "open", int64(s.OpenConnections))
+			setPoolStat(name, "in_use", int64(s.InUse))
+			setPoolStat(name, "idle", int64(s.Idle))
+			setPoolStat(name, "wait_count", s.WaitCount)
+			setPoolStat(name, "wait_duration_ms", s.WaitDuration.Milliseconds())
+			setPoolStat(name, "max_idle_closed", s.MaxIdleClosed)
+			setPoolStat(name, "max_lifetime_closed", s.MaxLifetimeClosed)
+		}
+	}
+}
+
+func setPoolStat(pool, stat string, v int64) {
+	i := new(expvar.Int)
+	i.Set(v)
+	poolStats.Set(pool+"_"+stat, i)
+}
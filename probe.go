@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// Probe writes the capabilities of the database to w, such as the version,
+// txn modes and limits, to pick the flags which the database supports.
+func Probe(ctx context.Context, db *sql.DB, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	report := func(name string, value interface{}) {
+		fmt.Fprintf(bw, "%-24s %v\n", name+":", value)
+	}
+	// queryValue returns the single value of query, or the error as the value
+	queryValue := func(query string) string {
+		var v sql.NullString
+		if err := db.QueryRowContext(ctx, query).Scan(&v); err != nil {
+			return fmt.Sprintf("unknown (%v)", err)
+		}
+		return v.String
+	}
+
+	var version string
+	if err := db.QueryRowContext(ctx, "select version()").Scan(&version); err != nil {
+		return errors.Annotate(err, "select version")
+	}
+	report("version", version)
+	report("tidb", TiDBDatabase)
+	if TiDBDatabase {
+		report("tidb_version", "\n"+queryValue("select tidb_version()"))
+		report("txn mode", queryValue("select @@tidb_txn_mode"))
+		report("pessimistic", probePessimistic(ctx, db))
+	}
+	var isolation string
+	if err := db.QueryRowContext(ctx, "select @@transaction_isolation").Scan(&isolation); err != nil {
+		// MySQL before 5.7.20 only has tx_isolation
+		isolation = queryValue("select @@tx_isolation")
+	}
+	report("isolation", isolation)
+	report("max_allowed_packet", queryValue("select @@max_allowed_packet"))
+	report("local_infile", queryValue("select @@local_infile"))
+	report("savepoint", SupportSavepoint(db))
+	return errors.Trace(bw.Flush())
+}
+
+// probePessimistic checks whether TiDB can begin a pessimistic transaction,
+// without changing the global txn mode.
+func probePessimistic(ctx context.Context, db *sql.DB) string {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	}
+	defer conn.Close()
+	for _, query := range []string{"begin pessimistic", "rollback"} {
+		if _, err = conn.ExecContext(ctx, query); err != nil {
+			return fmt.Sprintf("false (%v)", err)
+		}
+	}
+	return "true"
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+)
+
+// initProgress logs how many of the accounts of a table are inserted every
+// InitProgressInterval until it's stopped.
+type initProgress struct {
+	inserted int64
+	batches  int64
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// startInitProgress starts logging the progress of inserting total accounts
+// into table, nothing is logged if InitProgressInterval isn't positive.
+func (c *BankCase) startInitProgress(table string, total int) *initProgress {
+	p := &initProgress{stopCh: make(chan struct{}), doneCh: make(chan struct{})}
+	if c.cfg.InitProgressInterval <= 0 || total <= 0 {
+		close(p.doneCh)
+		return p
+	}
+	go func() {
+		defer close(p.doneCh)
+		ticker := time.NewTicker(c.cfg.InitProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ticker.C:
+				inserted := atomic.LoadInt64(&p.inserted)
+				log.Infof("[%s] %d/%d accounts inserted into %s (%.1f%%)", c, inserted, total, table, float64(inserted)*100/float64(total))
+			}
+		}
+	}()
+	return p
+}
+
+// add counts a batch of n accounts inserted, it returns the number of the
+// batches inserted.
+func (p *initProgress) add(n int) int64 {
+	atomic.AddInt64(&p.inserted, int64(n))
+	return atomic.AddInt64(&p.batches, 1)
+}
+
+// stop stops logging and waits for the logging goroutine to exit.
+func (p *initProgress) stop() {
+	close(p.stopCh)
+	<-p.doneCh
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// Dump formats of the record table.
+const (
+	dumpCSV  = "csv"
+	dumpJSON = "json"
+)
+
+// transferRecord is a row of the record table.
+type transferRecord struct {
+	ID          int64  `json:"id"`
+	FromID      int64  `json:"from_id"`
+	ToID        int64  `json:"to_id"`
+	FromBalance uint64 `json:"from_balance"`
+	ToBalance   uint64 `json:"to_balance"`
+	Amount      int64  `json:"amount"`
+	TSO         uint64 `json:"tso"`
+}
+
+// lostUpdateSettle is how long the records up to an id are settled after a
+// verify reads it, no transaction holding a smaller id is still running then.
+// The long-term transactions run for MaxDelay more.
+const lostUpdateSettle = 5 * time.Minute
+
+// lostUpdateReplay is the replay kept by verifyLostUpdate between the
+// verifies, so every verify only replays the records after base. The records
+// are folded into base once they're settled, the later ones are replayed on
+// top of it by every verify.
+type lostUpdateReplay struct {
+	mu sync.Mutex
+	// base is the replay of the records up to baseID, nil until the first verify
+	base   *recordReplay
+	baseID int64
+	// marks are the max record ids the verifies read and when
+	marks []recordMark
+}
+
+type recordMark struct {
+	at time.Time
+	id int64
+}
+
+// settledID returns the max record id read by the verifies at least settle
+// ago, the marks up to it are dropped. It's baseID if there is no such mark.
+func (r *lostUpdateReplay) settledID(now time.Time, settle time.Duration) int64 {
+	id := r.baseID
+	for len(r.marks) > 0 && now.Sub(r.marks[0].at) >= settle {
+		if r.marks[0].id > id {
+			id = r.marks[0].id
+		}
+		r.marks = r.marks[1:]
+	}
+	return id
+}
+
+// verifyLostUpdate replays the record table in tx ordered by id, the balances
+// every transfer read must equal the balances the previous transfers on the
+// accounts left. The auto increment ids must follow the commit order of the
+// transfers on an account, which holds on a single TiDB or MySQL server.
+func (c *BankCase) verifyLostUpdate(ctx context.Context, tx *sql.Tx) error {
+	r := &c.lostUpdate
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.base == nil {
+		r.base, r.baseID, r.marks = newRecordReplay(c.cfg.InitialBalance, nil), 0, nil
+	}
+	settle := lostUpdateSettle
+	if c.cfg.EnableLongTxn {
+		settle += c.cfg.MaxDelay
+	}
+	settled := r.settledID(time.Now(), settle)
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s WHERE id > ? ORDER BY id", c.recordTable()), r.baseID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	// the settled records come first, they're replayed on base directly
+	tail := newRecordReplay(c.cfg.InitialBalance, r.base)
+	maxID, count := r.baseID, 0
+	for rows.Next() {
+		var rec transferRecord
+		if err = rows.Scan(&rec.ID, &rec.FromID, &rec.ToID, &rec.FromBalance, &rec.ToBalance, &rec.Amount, &rec.TSO); err != nil {
+			return errors.Trace(err)
+		}
+		if rec.ID <= settled {
+			if err = r.base.replay(rec); err != nil {
+				// base is broken, the next verify replays all records
+				r.base = nil
+				return err
+			}
+			r.baseID = rec.ID
+		} else if err = tail.replay(rec); err != nil {
+			return err
+		}
+		maxID = rec.ID
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	r.marks = append(r.marks, recordMark{at: time.Now(), id: maxID})
+	log.Infof("[%s] replay %d records after record %d without lost updates", c, count, r.baseID)
+	return nil
+}
+
+// verifyTSOOrder replays the record table in tx ordered by tso, the balances
+// must progress in the tso order of the transfers on every account. The tso
+// is the start ts of the transaction, whose order on an account is the commit
+// order for optimistic transactions only.
+func (c *BankCase) verifyTSOOrder(ctx context.Context, tx *sql.Tx) error {
+	// the transfers of a transaction share the tso, they're in id order
+	count, err := c.replayRecords(ctx, tx, "tso, id")
+	if err != nil {
+		return err
+	}
+	log.Infof("[%s] replay %d records in tso order", c, count)
+	return nil
+}
+
+// replayRecords replays the record table in tx ordered by orderBy, the
+// balances every transfer read must equal the balances the previous transfer
+// on the accounts left. It returns the number of the records replayed.
+func (c *BankCase) replayRecords(ctx context.Context, tx *sql.Tx, orderBy string) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s ORDER BY %s", c.recordTable(), orderBy))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	replay := newRecordReplay(c.cfg.InitialBalance, nil)
+	var count int
+	for rows.Next() {
+		var r transferRecord
+		if err = rows.Scan(&r.ID, &r.FromID, &r.ToID, &r.FromBalance, &r.ToBalance, &r.Amount, &r.TSO); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if err = replay.replay(r); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, errors.Trace(rows.Err())
+}
+
+// recordReplay holds the records which last touch the accounts, the ones
+// missing are looked up in parent if it's set.
+type recordReplay struct {
+	initialBalance uint64
+	parent         *recordReplay
+	last           map[int64]transferRecord
+}
+
+func newRecordReplay(initialBalance uint64, parent *recordReplay) *recordReplay {
+	return &recordReplay{initialBalance: initialBalance, parent: parent, last: make(map[int64]transferRecord)}
+}
+
+// lastRecord returns the record which last touches the account id.
+func (p *recordReplay) lastRecord(id int64) (transferRecord, bool) {
+	if r, ok := p.last[id]; ok {
+		return r, true
+	}
+	if p.parent != nil {
+		return p.parent.lastRecord(id)
+	}
+	return transferRecord{}, false
+}
+
+// balance returns the balance of the account after its last record.
+func (p *recordReplay) balance(id int64) uint64 {
+	r, ok := p.lastRecord(id)
+	switch {
+	case !ok:
+		return p.initialBalance
+	case r.FromID == id:
+		return r.FromBalance - uint64(r.Amount)
+	default:
+		return r.ToBalance + uint64(r.Amount)
+	}
+}
+
+// replay checks the balances r read are the ones the last records of the
+// accounts left, then applies r.
+func (p *recordReplay) replay(r transferRecord) error {
+	for _, account := range []struct {
+		id   int64
+		read uint64
+	}{{r.FromID, r.FromBalance}, {r.ToID, r.ToBalance}} {
+		if left := p.balance(account.id); account.read != left {
+			prev, _ := p.lastRecord(account.id)
+			return mismatchError{errors.Errorf("account %d: record %d at tso %d reads %d, but record %d at tso %d leaves %d",
+				account.id, r.ID, r.TSO, account.read, prev.ID, prev.TSO, left)}
+		}
+	}
+	p.last[r.FromID], p.last[r.ToID] = r, r
+	return nil
+}
+
+// DumpRecords streams the record table named table to w in csv, or in json
+// with one record per line.
+func DumpRecords(ctx context.Context, db *sql.DB, table string, w io.Writer, format string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s ORDER BY id", table))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	var (
+		csvWriter *csv.Writer
+		encoder   *json.Encoder
+	)
+	switch format {
+	case dumpCSV:
+		csvWriter = csv.NewWriter(bw)
+		if err = csvWriter.Write([]string{"id", "from_id", "to_id", "from_balance", "to_balance", "amount", "tso"}); err != nil {
+			return errors.Trace(err)
+		}
+	case dumpJSON:
+		encoder = json.NewEncoder(bw)
+	default:
+		return errors.Errorf("unknown dump format %s", format)
+	}
+
+	for rows.Next() {
+		var r transferRecord
+		if err = rows.Scan(&r.ID, &r.FromID, &r.ToID, &r.FromBalance, &r.ToBalance, &r.Amount, &r.TSO); err != nil {
+			return errors.Trace(err)
+		}
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{
+				strconv.FormatInt(r.ID, 10),
+				strconv.FormatInt(r.FromID, 10),
+				strconv.FormatInt(r.ToID, 10),
+				strconv.FormatUint(r.FromBalance, 10),
+				strconv.FormatUint(r.ToBalance, 10),
+				strconv.FormatInt(r.Amount, 10),
+				strconv.FormatUint(r.TSO, 10),
+			})
+		} else {
+			err = encoder.Encode(&r)
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err = csvWriter.Error(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(bw.Flush())
+}
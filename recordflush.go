@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	// recordFlushBatch is the max number of the records inserted by a flush
+	recordFlushBatch = 256
+	// recordFlushInterval is the interval to flush the buffered records
+	recordFlushInterval = 100 * time.Millisecond
+	// recordFlushTimeout is the timeout of a flush
+	recordFlushTimeout = time.Minute
+)
+
+// With RecordAsync the transfers don't insert their records in their
+// transactions, the records are sent to recordCh after the transactions commit
+// and flushRecords inserts them in batches. The record table lags behind the
+// accounts tables then, a transfer may be committed without its record for a
+// while, or forever if the bank case crashes, so the checks which replay or
+// sum the records refuse RecordAsync.
+
+// flushRecords inserts the records received from recordCh in batches until
+// recordCh is closed, the records left are flushed before it returns.
+func (c *BankCase) flushRecords(db *sql.DB, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(recordFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]interface{}, 0, recordFlushBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := c.insertRecords(db, batch); err != nil {
+			log.Errorf("[%s] flush %d records error %v", c, len(batch), err)
+			c.stop(errors.Annotatef(err, "flush %d records", len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case args, ok := <-c.recordCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, args)
+			if len(batch) >= recordFlushBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// insertRecords inserts the records of batch in one statement, every record
+// has the args of an insert of the record table without fanout.
+func (c *BankCase) insertRecords(db *sql.DB, batch [][]interface{}) error {
+	values := make([]string, 0, len(batch))
+	for _, args := range batch {
+		values = append(values, bindArgs("(?, ?, ?, ?, ?, ?)", args...))
+	}
+	query := fmt.Sprintf("INSERT INTO %s (from_id, to_id, from_balance, to_balance, amount, tso) VALUES %s",
+		c.recordTable(), strings.Join(values, ", "))
+	ctx, cancel := context.WithTimeout(context.Background(), recordFlushTimeout)
+	defer cancel()
+	return RunWithRetry(ctx, c.cfg.RetryLimit, 100*time.Millisecond, func() error {
+		_, err := db.ExecContext(ctx, query)
+		return errors.Trace(err)
+	})
+}
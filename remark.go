@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// multibyteRemarkRunes are the characters of the multi-byte remarks, they mix
+// 2, 3 and 4 bytes UTF-8 characters.
+var multibyteRemarkRunes = []rune("éüßØåñ银行转账一致性事务测试数据库검증テストЖЯΩ😀🚀💰🏦🧪")
+
+// maxRemarkRunes is the max characters of a multi-byte remark, the column is VARCHAR(128).
+const maxRemarkRunes = 100
+
+// remarkSampleSize is the number of the accounts whose remarks are checked in a verify.
+const remarkSampleSize = 100
+
+// accountRemark returns the remark of account id. The multi-byte remark is
+// derived from id so verify can check it, the ASCII one is random.
+func (c *BankCase) accountRemark(id int) string {
+	if !c.cfg.MultibyteRemark {
+		return remark[:rand.Intn(len(remark))]
+	}
+	n := id % maxRemarkRunes
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = multibyteRemarkRunes[(id+i)%len(multibyteRemarkRunes)]
+	}
+	return string(runes)
+}
+
+// verifyRemark checks the remarks of the sampled accounts round-trip byte for byte.
+func (c *BankCase) verifyRemark(ctx context.Context, tx *sql.Tx, index string, numAccounts int) error {
+	ids := make([]string, remarkSampleSize)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%d", c.accountID(rand.Intn(numAccounts)))
+	}
+	query := fmt.Sprintf("select id, remark from %s where id in (%s)", c.accountsTable(index), strings.Join(ids, ", "))
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     int
+			remark string
+		)
+		if err = rows.Scan(&id, &remark); err != nil {
+			return errors.Trace(err)
+		}
+		if want := c.accountRemark(id); remark != want {
+			return mismatchError{errors.Errorf("%s id %d remark is %x, want %x", c.accountsTable(index), id, remark, want)}
+		}
+	}
+	return errors.Trace(rows.Err())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// ReplayVerify rebuilds the balances of the first accounts table by applying
+// the record table in tso order to the initial balances, and compares them
+// with the accounts row by row in the same snapshot. Every discrepancy is
+// written to w, it returns a mismatchError if there is any. The records are
+// streamed, only the changed balances are kept in memory.
+func (c *BankCase) ReplayVerify(ctx context.Context, db *sql.DB, w io.Writer) error {
+	table := c.accountsTable(tableIndex(0))
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	// deltas are the changes of the balances by the records
+	deltas := make(map[int64]int64)
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s ORDER BY tso, id", c.recordTable()))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var records int
+	for rows.Next() {
+		var r transferRecord
+		if err = rows.Scan(&r.ID, &r.FromID, &r.ToID, &r.FromBalance, &r.ToBalance, &r.Amount, &r.TSO); err != nil {
+			rows.Close()
+			return errors.Trace(err)
+		}
+		deltas[r.FromID] -= r.Amount
+		deltas[r.ToID] += r.Amount
+		records++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	rows, err = tx.QueryContext(ctx, fmt.Sprintf("SELECT id, balance FROM %s ORDER BY id", table))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+	bw := bufio.NewWriter(w)
+	var accounts, mismatched int
+	for rows.Next() {
+		var (
+			id      int64
+			balance uint64
+		)
+		if err = rows.Scan(&id, &balance); err != nil {
+			return errors.Trace(err)
+		}
+		accounts++
+		delta := deltas[id]
+		delete(deltas, id)
+		// the arithmetic wraps around for the unsigned balances over MaxInt64
+		if expected := c.cfg.InitialBalance + uint64(delta); balance != expected {
+			fmt.Fprintf(bw, "account %d balance %d, but its records leave %d\n", id, balance, expected)
+			mismatched++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	// the accounts of the records which are missing in the table
+	for id := range deltas {
+		fmt.Fprintf(bw, "account %d is missing, but it has records\n", id)
+		mismatched++
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.Trace(err)
+	}
+	numAccounts := c.cfg.NumAccounts[0]
+	fmt.Fprintf(bw, "%s: %d records replayed, %d accounts, %d mismatched\n", table, records, accounts, mismatched)
+	if err = bw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("[%s] replay %d records on %d accounts of %s, %d mismatched", c, records, accounts, table, mismatched)
+
+	if mismatched > 0 {
+		return mismatchError{errors.Errorf("%s has %d accounts mismatching the records", table, mismatched)}
+	}
+	if accounts != numAccounts {
+		return mismatchError{errors.Errorf("%s count must %d, but got %d", table, numAccounts, accounts)}
+	}
+	return nil
+}
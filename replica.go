@@ -0,0 +1,36 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// WaitReplica waits until the replica db has all the accounts of every table,
+// the accounts are inserted by many transactions during init, the replica
+// may lag behind. It gives up after VerifyTimeout.
+func (c *BankCase) WaitReplica(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.VerifyTimeout)
+	defer cancel()
+	for i := 0; i < c.cfg.TableNum; i++ {
+		table, numAccounts := c.accountsTable(tableIndex(i)), c.cfg.NumAccounts[i]
+		for {
+			var count int
+			err := db.QueryRowContext(ctx, fmt.Sprintf("select count(*) from %s", table)).Scan(&count)
+			if err == nil && count == numAccounts {
+				break
+			}
+			log.Infof("[%s] wait for the replica to have %d accounts of %s, got %d, error %v", c, numAccounts, table, count, err)
+			select {
+			case <-ctx.Done():
+				return errors.Annotatef(ctx.Err(), "wait for the replica of %s", table)
+			case <-time.After(c.cfg.Interval):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// runReport is the JSON summary of a run.
+type runReport struct {
+	// Attempted is the number of transfers, Committed and Failed are their results
+	Attempted int64 `json:"attempted"`
+	Committed int64 `json:"committed"`
+	Failed    int64 `json:"failed"`
+	// Retries is the number of the transactions retried for retryable errors or chaos
+	Retries int64 `json:"retries"`
+	// DurationSeconds is how long the run lasts, including the init, the
+	// wait for the replica and the warmup
+	DurationSeconds float64 `json:"duration_seconds"`
+	// TransferSeconds is how long the transfers are measured, from the end of
+	// the warmup to the end of the transfers, TPS is the committed ones in it
+	TransferSeconds float64 `json:"transfer_seconds"`
+	TPS             float64 `json:"tps"`
+	// Verify is "ok" if the run ends without error, otherwise it's the error
+	Verify            string           `json:"verify"`
+	InvariantViolated bool             `json:"invariant_violated"`
+	LatencyMS         map[string]int64 `json:"latency_ms"`
+	// Attempts is the distribution of the attempts of the committed transfers
+	Attempts map[string]int64 `json:"attempts"`
+	// Init is the summary of the accounts tables initialized, it's omitted
+	// if the existing tables are reused
+	Init *initReport `json:"init,omitempty"`
+}
+
+// initReport is the summary of the init.
+type initReport struct {
+	Accounts          int64                      `json:"accounts"`
+	Seconds           float64                    `json:"seconds"`
+	AccountsPerSecond float64                    `json:"accounts_per_second"`
+	Tables            map[string]initTableReport `json:"tables"`
+}
+
+// initTableReport is the summary of the init of an accounts table.
+type initTableReport struct {
+	Accounts int64   `json:"accounts"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// newInitReport returns the summary of the init, or nil if no table is initialized.
+func newInitReport() *initReport {
+	r := &initReport{Tables: make(map[string]initTableReport)}
+	initAccounts.Do(func(kv expvar.KeyValue) {
+		t := initTableReport{}
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			t.Accounts = v.Value()
+		}
+		if v, ok := initSeconds.Get(kv.Key).(*expvar.Float); ok {
+			t.Seconds = v.Value()
+		}
+		r.Tables[kv.Key] = t
+		r.Accounts += t.Accounts
+		r.Seconds += t.Seconds
+	})
+	if len(r.Tables) == 0 {
+		return nil
+	}
+	if r.Seconds > 0 {
+		r.AccountsPerSecond = float64(r.Accounts) / r.Seconds
+	}
+	return r
+}
+
+// transferDuration returns how long the transfers are measured, it's 0 if
+// the warmup doesn't end.
+func (c *BankCase) transferDuration() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.measureStart.IsZero() {
+		return 0
+	}
+	end := c.measureEnd
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(c.measureStart)
+}
+
+// writeReport writes the summary of the run which lasts duration, measures
+// the transfers for transferDuration and ends with runErr to file.
+func writeReport(file string, duration, transferDuration time.Duration, runErr error) error {
+	committed, failed := sumMap(txnCommitted), sumMap(txnFailed)
+	r := runReport{
+		Attempted:         committed + failed,
+		Committed:         committed,
+		Failed:            failed,
+		Retries:           sumMap(txnRetryableError) + sumMap(txnChaosKilled) + sumMap(txnLockNowait) + sumMap(txnDeadlock),
+		DurationSeconds:   duration.Seconds(),
+		TransferSeconds:   transferDuration.Seconds(),
+		Verify:            "ok",
+		InvariantViolated: errors.Cause(runErr) == ErrInvariantViolation,
+		LatencyMS:         txnLatency.percentiles(),
+		Attempts:          make(map[string]int64),
+		Init:              newInitReport(),
+	}
+	txnAttempts.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			r.Attempts[kv.Key] = v.Value()
+		}
+	})
+	if transferDuration > 0 {
+		r.TPS = float64(committed) / transferDuration.Seconds()
+	}
+	if runErr != nil {
+		r.Verify = runErr.Error()
+	}
+
+	b, err := json.MarshalIndent(&r, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(file, append(b, '\n'), 0644))
+}
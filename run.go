@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// Run modes.
+const (
+	// modeInit only initializes the tables
+	modeInit = "init"
+	// modeRun runs transfers on the initialized tables
+	modeRun = "run"
+	// modeInitAndRun initializes the tables and runs transfers
+	modeInitAndRun = "init+run"
+	// modeVerifyOnce verifies the tables once and exits
+	modeVerifyOnce = "verify-once"
+	// modeDumpRecords dumps the record table and exits
+	modeDumpRecords = "dump-records"
+	// modeCleanup drops the tables and exits
+	modeCleanup = "cleanup"
+	// modeProbe reports the capabilities of the database and exits
+	modeProbe = "probe"
+	// modeSnapshotDiff diffs two state snapshots against the record table and exits
+	modeSnapshotDiff = "snapshot-diff"
+	// modeReplayVerify rebuilds the balances from the record table, compares
+	// them with the accounts and exits
+	modeReplayVerify = "replay-verify"
+)
+
+// Run opens the database of dsn and runs the bank case in cfg.Mode until ctx
+// is done. It returns the error which stops the bank case, such as a balance
+// mismatch, instead of exiting the process.
+func Run(ctx context.Context, cfg Config, dsn string) error {
+	if err := cfg.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := setupDB(ctx, &cfg, dsn); err != nil {
+		return errors.Trace(err)
+	}
+
+	db, err := openDB(dsn, &cfg, cfg.Concurrency)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+
+	// verifyDB is the replica to verify on if VerifyAddr is set
+	verifyDB := db
+	if cfg.VerifyAddr != "" {
+		verifyDSN, err := replaceAddr(dsn, cfg.VerifyAddr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if verifyDB, err = OpenDB(verifyDSN, cfg.VerifyConcurrency+2); err != nil {
+			return errors.Trace(err)
+		}
+		defer verifyDB.Close()
+		log.Infof("[bank] verify on %s", redactDSN(verifyDSN))
+	}
+	if cfg.KeepaliveInterval > 0 {
+		go keepAlive(ctx, db, "transfer", cfg.KeepaliveInterval)
+		if verifyDB != db {
+			go keepAlive(ctx, verifyDB, "verify", cfg.KeepaliveInterval)
+		}
+	}
+
+	if cfg.PessimisticRatio >= 0 && !TiDBDatabase {
+		log.Warnf("[bank] -pessimistic-ratio only works on TiDB, ignore it")
+		cfg.PessimisticRatio = -1
+	}
+	if cfg.VerifyTSOOrder && !TiDBDatabase {
+		log.Warnf("[bank] -verify-tso-order only works on TiDB, ignore it")
+		cfg.VerifyTSOOrder = false
+	}
+	if cfg.StaleRead > 0 && !TiDBDatabase {
+		log.Warnf("[bank] -stale-read only works on TiDB, ignore it")
+		cfg.StaleRead = 0
+	}
+	if cfg.ClusteredIndex != ClusteredIndexDefault && !TiDBDatabase {
+		log.Warnf("[bank] -clustered-index only works on TiDB, ignore it")
+		cfg.ClusteredIndex = ClusteredIndexDefault
+	}
+	if (cfg.ExportSnapshot != "" || cfg.VerifyAtSnapshot != "") && !TiDBDatabase {
+		log.Warnf("[bank] -export-snapshot and -verify-at-snapshot only work on TiDB, ignore them")
+		cfg.ExportSnapshot, cfg.VerifyAtSnapshot = "", ""
+	}
+	if cfg.LockMode == LockNone && !TiDBDatabase {
+		log.Warnf("[bank] -lock-mode %s only works with the optimistic transactions of TiDB, use %s", LockNone, LockForUpdate)
+		cfg.LockMode = LockForUpdate
+	}
+	if cfg.VerifyTiFlash && !TiDBDatabase {
+		log.Warnf("[bank] -verify-tiflash only works on TiDB, ignore it")
+		cfg.VerifyTiFlash = false
+	}
+	if cfg.EnableSavepoint && !SupportSavepoint(db) {
+		log.Warnf("[bank] the database doesn't support savepoint, disable savepoint transactions")
+		cfg.EnableSavepoint = false
+	}
+
+	bank := NewBankCase(&cfg)
+	defer func() {
+		if err := bank.Close(); err != nil {
+			log.Errorf("[bank] close error %v", err)
+		}
+	}()
+	if cfg.VerifyLog != "" {
+		if err = bank.OpenVerifyLog(); err != nil {
+			return err
+		}
+	}
+	if cfg.StatusAddr != "" {
+		go StartStatusServer(ctx, cfg.StatusAddr, bank)
+	}
+	if cfg.ControlAddr != "" {
+		go StartControlServer(ctx, cfg.ControlAddr, bank)
+	}
+	go handlePauseSignals(ctx, bank)
+
+	switch cfg.Mode {
+	case modeDumpRecords:
+		return errors.Trace(dumpRecords(ctx, db, bank.recordTable(), cfg.DumpFile, cfg.DumpFormat))
+	case modeCleanup:
+		return bank.Cleanup(ctx, db)
+	case modeProbe:
+		return errors.Trace(Probe(ctx, db, os.Stdout))
+	case modeSnapshotDiff:
+		return errors.Trace(DiffStateSnapshots(ctx, db, bank.recordTable(), cfg.SnapshotDiff[0], cfg.SnapshotDiff[1], os.Stdout))
+	case modeReplayVerify:
+		return errors.Trace(bank.ReplayVerify(ctx, verifyDB, os.Stdout))
+	case modeVerifyOnce:
+		if err = bank.VerifyOnce(ctx, verifyDB); err != nil {
+			return err
+		}
+		log.Infof("[bank] verify success")
+		return nil
+	}
+
+	if err = bank.ReconcileTables(ctx, db); err != nil {
+		return errors.Annotate(err, "reconcile tables")
+	}
+
+	// report writes the summary of the run ending with err, the failed init
+	// is reported too
+	start := time.Now()
+	report := func(err error) {
+		if cfg.ReportFile == "" {
+			return
+		}
+		if reportErr := writeReport(cfg.ReportFile, time.Since(start), bank.transferDuration(), err); reportErr != nil {
+			log.Errorf("[bank] write report error %v", reportErr)
+		}
+	}
+	if cfg.Mode != modeRun {
+		if err = bank.Initialize(ctx, db); err != nil {
+			err = errors.Annotate(err, "initial failed")
+			report(err)
+			return err
+		}
+	}
+	if cfg.Mode == modeInit {
+		report(nil)
+		return nil
+	}
+	if cfg.Mode == modeRun {
+		if err = bank.CheckSchema(ctx, db); err != nil {
+			report(err)
+			return err
+		}
+	}
+
+	if cfg.VerifyAddr != "" {
+		if err = bank.WaitReplica(ctx, verifyDB); err != nil {
+			report(err)
+			return err
+		}
+	}
+	bank.StartVerify(ctx, verifyDB)
+	err = bank.Execute(ctx, db)
+	report(err)
+	if cfg.OnMismatch == OnMismatchPause && errors.Cause(err) == ErrInvariantViolation {
+		pauseOnMismatch(ctx, db, bank)
+	}
+	return err
+}
+
+// pauseOnMismatch dumps the accounts tables for the invariant violation, then
+// keeps the process and the database connections alive until ctx is done.
+func pauseOnMismatch(ctx context.Context, db *sql.DB, bank *BankCase) {
+	dumpCtx, cancel := context.WithTimeout(ctx, finalVerifyTimeout)
+	for i := 0; i < bank.cfg.TableNum; i++ {
+		file, err := bank.snapshotState(dumpCtx, db, tableIndex(i))
+		if err != nil {
+			log.Errorf("[bank] dump %s error %v", bank.accountsTable(tableIndex(i)), err)
+			continue
+		}
+		log.Infof("[bank] dump %s to %s", bank.accountsTable(tableIndex(i)), file)
+	}
+	cancel()
+	log.Warnf("[bank] pause on the invariant violation for inspection, send SIGINT or SIGTERM to exit")
+	<-ctx.Done()
+}
+
+// setupDB waits for the database to be connectable, then detects whether it
+// is TiDB and sets the global txn mode.
+func setupDB(ctx context.Context, cfg *Config, dsn string) error {
+	db, err := openDB(dsn, cfg, 1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	err = RunWithRetry(connectCtx, -1, time.Second, func() error {
+		err := db.PingContext(connectCtx)
+		if err != nil {
+			log.Warnf("[bank] connect to database error %v, retry", err)
+		}
+		return err
+	})
+	if err == nil {
+		// RunWithRetry returns nil if it times out
+		err = connectCtx.Err()
+	}
+	if err != nil {
+		db.Close()
+		return errors.Annotatef(err, "connect to database in %s", cfg.ConnectTimeout)
+	}
+
+	_, err = db.Exec("select tidb_version();")
+	if err != nil {
+		TiDBDatabase = false
+		log.Infof("[bank] select tidb_version(): %v", err)
+	}
+
+	// probe mode doesn't change the database
+	probe := cfg.Mode == modeProbe
+	if TiDBDatabase {
+		if cfg.Pessimistic && !probe {
+			_, err = db.Exec("set @@global.tidb_txn_mode = 'pessimistic';")
+			if err != nil {
+				db.Close()
+				return errors.Annotate(err, "set pessimistic failed")
+			}
+		}
+
+		var txnMode string
+		if err = db.QueryRow("select @@tidb_txn_mode").Scan(&txnMode); err == nil {
+			log.Infof("[bank] Current txmode: %v", txnMode)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		return errors.Annotate(err, "fail to close set txmode conn")
+	}
+
+	if probe {
+		return nil
+	}
+	// wait for the global txn mode to take effect
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+func dumpRecords(ctx context.Context, db *sql.DB, table string, file string, format string) error {
+	w := os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return DumpRecords(ctx, db, table, w, format)
+}
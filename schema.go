@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	tmysql "github.com/pingcap/parser/mysql"
+	"golang.org/x/net/context"
+)
+
+// Clusterings of the primary keys of the accounts tables.
+const (
+	// ClusteredIndexDefault leaves it to the database
+	ClusteredIndexDefault = ""
+	// ClusteredIndexOn clusters the rows by the primary keys
+	ClusteredIndexOn = "clustered"
+	// ClusteredIndexOff keys the rows by the hidden row ids
+	ClusteredIndexOff = "nonclustered"
+)
+
+// clusteredClauses are the primary key clauses of the clusterings.
+var clusteredClauses = map[string]string{
+	ClusteredIndexOn:  " CLUSTERED",
+	ClusteredIndexOff: " NONCLUSTERED",
+}
+
+// accountShards is the number of the shards of the composite keys.
+const accountShards = 16
+
+// accountShard returns the shard of account id in the composite key.
+func accountShard(id int) int {
+	return id % accountShards
+}
+
+// insertColumns returns the columns the accounts are initialized with.
+func (c *BankCase) insertColumns() string {
+	if c.cfg.CompositeKey {
+		return "id, balance, remark, shard"
+	}
+	return "id, balance, remark"
+}
+
+// accountValues returns the values of insertColumns of an account.
+func (c *BankCase) accountValues(id int, balance uint64, remark string) string {
+	if c.cfg.CompositeKey {
+		return fmt.Sprintf("(%d, %d, \"%s\", %d)", id, balance, remark, accountShard(id))
+	}
+	return fmt.Sprintf("(%d, %d, \"%s\")", id, balance, remark)
+}
+
+// accountsColumns returns the columns and data types the accounts tables should have.
+func (c *BankCase) accountsColumns() map[string]string {
+	columns := map[string]string{
+		"id":      "bigint",
+		"balance": "bigint",
+		"remark":  "varchar",
+	}
+	if c.cfg.TrackUpdatedAt {
+		columns["updated_at"] = "bigint"
+	}
+	if c.cfg.GeneratedColumn {
+		columns["balance_category"] = "bigint"
+	}
+	if c.cfg.CompositeKey {
+		columns["shard"] = "bigint"
+	}
+	return columns
+}
+
+// recordColumns returns the columns and data types the record table should have.
+func (c *BankCase) recordColumns() map[string]string {
+	columns := map[string]string{
+		"id":           "bigint",
+		"from_id":      "bigint",
+		"to_id":        "bigint",
+		"from_balance": "bigint",
+		"to_balance":   "bigint",
+		"amount":       "bigint",
+		"tso":          "bigint",
+	}
+	if c.cfg.RecordFanout > 1 {
+		columns["seq"] = "int"
+	}
+	return columns
+}
+
+// analyzeTables analyzes the accounts tables and the record table. It's only
+// for the query plans, the databases without ANALYZE TABLE are skipped and the
+// failures are logged only.
+func (c *BankCase) analyzeTables(ctx context.Context, db *sql.DB) {
+	var tables []string
+	for i := 0; i < c.cfg.TableNum; i++ {
+		tables = append(tables, c.accountsTable(tableIndex(i)))
+	}
+	if !c.cfg.DisableRecord {
+		tables = append(tables, c.recordTable())
+	}
+	for _, table := range tables {
+		start := time.Now()
+		_, err := db.ExecContext(ctx, fmt.Sprintf("analyze table %s", table))
+		if isMySQLError(err, tmysql.ErrParse, tmysql.ErrNotSupportedYet) {
+			return
+		}
+		if err != nil {
+			log.Warnf("[%s] analyze table %s error %v", c, table, err)
+			continue
+		}
+		log.Infof("[%s] analyze table %s, takes %s", c, table, time.Since(start))
+	}
+}
+
+// CheckSchema checks the existing tables have the schema the bank case expects.
+func (c *BankCase) CheckSchema(ctx context.Context, db *sql.DB) error {
+	for i := 0; i < c.cfg.TableNum; i++ {
+		if err := c.checkAccountsSchema(ctx, db, tableIndex(i)); err != nil {
+			return err
+		}
+	}
+	return c.checkRecordSchema(ctx, db)
+}
+
+func (c *BankCase) checkAccountsSchema(ctx context.Context, db *sql.DB, index string) error {
+	if c.cfg.AccountsDDL != "" {
+		return checkTableColumns(ctx, db, c.accountsTable(index), accountsDDLColumns, true)
+	}
+	return checkTableColumns(ctx, db, c.accountsTable(index), c.accountsColumns(), false)
+}
+
+func (c *BankCase) checkRecordSchema(ctx context.Context, db *sql.DB) error {
+	if c.cfg.DisableRecord {
+		return nil
+	}
+	return checkTableColumns(ctx, db, c.recordTable(), c.recordColumns(), false)
+}
+
+// checkTableColumns compares the columns of table with the expected ones and
+// returns an error describing the difference. The unexpected columns are
+// allowed if allowExtra.
+func checkTableColumns(ctx context.Context, db *sql.DB, table string, expected map[string]string, allowExtra bool) error {
+	rows, err := db.QueryContext(ctx, "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = database() AND table_name = ?", table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	actual := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err = rows.Scan(&name, &dataType); err != nil {
+			return errors.Trace(err)
+		}
+		actual[strings.ToLower(name)] = strings.ToLower(dataType)
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	var diffs []string
+	for name, dataType := range expected {
+		got, ok := actual[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("missing column %s %s", name, dataType))
+		case got != dataType:
+			diffs = append(diffs, fmt.Sprintf("column %s is %s, want %s", name, got, dataType))
+		}
+	}
+	for name, dataType := range actual {
+		// the columns may be left by chaos DDL
+		if allowExtra || strings.HasPrefix(name, chaosColumnPrefix) {
+			continue
+		}
+		if _, ok := expected[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected column %s %s", name, dataType))
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	return errors.Errorf("table %s schema mismatch: %s", table, strings.Join(diffs, "; "))
+}
+
+// Reconcile policies of the accounts tables beyond TableNum.
+const (
+	// ReconcileWarn only warns about the extra tables
+	ReconcileWarn = "warn"
+	// ReconcileVerify verifies the sum of the extra tables once
+	ReconcileVerify = "verify"
+	// ReconcileDrop drops the extra tables
+	ReconcileDrop = "drop"
+)
+
+// ReconcileTables handles the accounts tables left by the runs with a larger
+// TableNum according to the ReconcileTables policy.
+func (c *BankCase) ReconcileTables(ctx context.Context, db *sql.DB) error {
+	tables, err := c.extraAccountsTables(ctx, db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, table := range tables {
+		switch c.cfg.ReconcileTables {
+		case ReconcileDrop:
+			if _, err = db.ExecContext(ctx, fmt.Sprintf("drop table if exists %s", table)); err != nil {
+				return errors.Annotatef(err, "drop table %s", table)
+			}
+			log.Infof("[%s] drop extra table %s", c, table)
+		case ReconcileVerify:
+			var (
+				count int
+				sum   []byte
+			)
+			query := fmt.Sprintf("select count(*), ifnull(sum(balance), 0) from %s", table)
+			if err = db.QueryRowContext(ctx, query).Scan(&count, &sum); err != nil {
+				return errors.Trace(err)
+			}
+			total, err := parseBigInt(sum)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if check := c.initialSum(count); total.Cmp(check) != 0 {
+				return invariantViolation("extra table %s total must %d, but got %d", table, check, total)
+			}
+			log.Infof("[%s] verify extra table %s success", c, table)
+		default:
+			log.Warnf("[%s] table %s is beyond -tables %d, it's not verified", c, table, c.cfg.TableNum)
+		}
+	}
+	return nil
+}
+
+// extraAccountsTables returns the existing accounts tables whose index is
+// not less than TableNum.
+func (c *BankCase) extraAccountsTables(ctx context.Context, db *sql.DB) ([]string, error) {
+	prefix := c.accountsTable("")
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("show tables like '%s%%'", prefix))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, errors.Trace(err)
+		}
+		suffix := strings.TrimPrefix(table, prefix)
+		if !strings.HasPrefix(table, prefix) || suffix == "" || suffix[0] == '0' {
+			continue
+		}
+		id, err := strconv.Atoi(suffix)
+		if err != nil || id < c.cfg.TableNum {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables, errors.Trace(rows.Err())
+}
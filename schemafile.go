@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"text/template"
+
+	"github.com/juju/errors"
+)
+
+// accountsDDLColumns are the columns the custom DDL of the accounts tables
+// must have, the transfers and the verifies use id and balance, the init
+// inserts remark too.
+var accountsDDLColumns = map[string]string{
+	"id":      "bigint",
+	"balance": "bigint",
+	"remark":  "varchar",
+}
+
+// accountsDDLData is the data of the template of the custom DDL, {{.Table}}
+// is the name of the accounts table.
+type accountsDDLData struct {
+	Table string
+}
+
+// parseAccountsDDL parses text as the template of the custom DDL of the
+// accounts tables, it must name the table by {{.Table}} and have the columns
+// of accountsDDLColumns.
+func parseAccountsDDL(text string) (*template.Template, error) {
+	tmpl, err := template.New("accounts").Parse(text)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse accounts DDL")
+	}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, accountsDDLData{Table: "accounts"}); err != nil {
+		return nil, errors.Annotate(err, "execute accounts DDL")
+	}
+	if b.String() == text {
+		return nil, errors.New("accounts DDL doesn't name the table by {{.Table}}")
+	}
+	for column := range accountsDDLColumns {
+		if !regexp.MustCompile(`(?i)\b` + column + `\b`).MatchString(text) {
+			return nil, errors.Errorf("accounts DDL doesn't have column %s", column)
+		}
+	}
+	return tmpl, nil
+}
+
+// accountsDDL returns the custom DDL of the accounts table with the suffix index.
+func (c *BankCase) accountsDDL(index string) (string, error) {
+	tmpl, err := parseAccountsDDL(c.cfg.AccountsDDL)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, accountsDDLData{Table: c.accountsTable(index)}); err != nil {
+		return "", errors.Trace(err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// maxSnapshotAccounts is the max accounts of the tables whose state can be
+// snapshotted, the diff holds a snapshot in memory.
+const maxSnapshotAccounts = 100000
+
+// maxDiffRecords is the max mismatched accounts whose records are printed by
+// DiffStateSnapshots.
+const maxDiffRecords = 10
+
+// stateSnapshot is the header of a state snapshot file, which is followed by
+// one "id balance" line per account.
+type stateSnapshot struct {
+	table string
+	// recordID is the max id of the record table in the snapshot, 0 if it's empty
+	recordID int64
+}
+
+func (s stateSnapshot) String() string {
+	return fmt.Sprintf("# %s %d", s.table, s.recordID)
+}
+
+// snapshotStates writes the state of the accounts table to StateSnapshotDir
+// every StateSnapshotInterval until the bank case stops.
+func (c *BankCase) snapshotStates(ctx context.Context, db *sql.DB) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.StateSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		file, err := c.snapshotState(ctx, db, tableIndex(0))
+		if err != nil {
+			log.Errorf("[%s] snapshot state error %v", c, err)
+			continue
+		}
+		log.Infof("[%s] snapshot state to %s", c, file)
+	}
+}
+
+// snapshotState streams the balances of all accounts of the index-th table
+// and the max record id read in one transaction to a new file in
+// StateSnapshotDir, it returns the file name.
+func (c *BankCase) snapshotState(ctx context.Context, db *sql.DB, index string) (string, error) {
+	table := c.accountsTable(index)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	var recordID sql.NullInt64
+	if !c.cfg.DisableRecord {
+		if err = tx.QueryRowContext(ctx, fmt.Sprintf("select max(id) from %s", c.recordTable())).Scan(&recordID); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("select id, balance from %s order by id", table))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer rows.Close()
+
+	file := filepath.Join(c.cfg.StateSnapshotDir, fmt.Sprintf("%s-%s.snapshot", table, time.Now().Format("20060102-150405.000")))
+	f, err := os.Create(file)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if _, err = fmt.Fprintln(w, stateSnapshot{table: table, recordID: recordID.Int64}); err != nil {
+		return "", errors.Trace(err)
+	}
+	for rows.Next() {
+		var (
+			id      int64
+			balance uint64
+		)
+		if err = rows.Scan(&id, &balance); err != nil {
+			return "", errors.Trace(err)
+		}
+		if _, err = fmt.Fprintf(w, "%d %d\n", id, balance); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return "", errors.Trace(err)
+	}
+	if err = w.Flush(); err != nil {
+		return "", errors.Trace(err)
+	}
+	return file, errors.Trace(f.Close())
+}
+
+// readStateSnapshot reads the header of the snapshot in r, then calls f for
+// every account.
+func readStateSnapshot(r io.Reader, f func(id int64, balance uint64) error) (stateSnapshot, error) {
+	var s stateSnapshot
+	br := bufio.NewReader(r)
+	if _, err := fmt.Fscanf(br, "# %s %d\n", &s.table, &s.recordID); err != nil {
+		return s, errors.Annotate(err, "read snapshot header")
+	}
+	for {
+		var (
+			id      int64
+			balance uint64
+		)
+		_, err := fmt.Fscanf(br, "%d %d\n", &id, &balance)
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return s, errors.Annotate(err, "read snapshot account")
+		}
+		if err = f(id, balance); err != nil {
+			return s, err
+		}
+	}
+}
+
+// DiffStateSnapshots compares the snapshots in the files oldFile and newFile
+// of the same accounts table. The delta of every account must equal the
+// transfers of the records between the snapshots in recordTable, the
+// mismatched accounts and their records are written to w.
+func DiffStateSnapshots(ctx context.Context, db *sql.DB, recordTable, oldFile, newFile string, w io.Writer) error {
+	oldF, err := os.Open(oldFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer oldF.Close()
+	balances := make(map[int64]uint64)
+	oldSnap, err := readStateSnapshot(oldF, func(id int64, balance uint64) error {
+		if len(balances) >= maxSnapshotAccounts {
+			return errors.Errorf("%s has more than %d accounts", oldFile, maxSnapshotAccounts)
+		}
+		balances[id] = balance
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	newF, err := os.Open(newFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer newF.Close()
+	// deltas are the changes of the balances, the accounts missing in either
+	// snapshot are reported as added or removed
+	deltas := make(map[int64]int64)
+	var added []int64
+	newSnap, err := readStateSnapshot(newF, func(id int64, balance uint64) error {
+		old, ok := balances[id]
+		if !ok {
+			added = append(added, id)
+			return nil
+		}
+		delete(balances, id)
+		if balance != old {
+			deltas[id] = int64(balance - old)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if oldSnap.table != newSnap.table {
+		return errors.Errorf("snapshots of different tables %s and %s", oldSnap.table, newSnap.table)
+	}
+	if oldSnap.recordID > newSnap.recordID {
+		return errors.Errorf("%s is older than %s", newFile, oldFile)
+	}
+
+	// subtract the transfers of the records between the snapshots
+	query := fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s WHERE id > ? AND id <= ? ORDER BY id", recordTable)
+	var count int
+	err = scanRecords(ctx, db, query, func(r transferRecord) {
+		deltas[r.FromID] += r.Amount
+		deltas[r.ToID] -= r.Amount
+		count++
+	}, oldSnap.recordID, newSnap.recordID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	mismatched := make([]int64, 0, len(deltas))
+	for id, delta := range deltas {
+		if delta != 0 {
+			mismatched = append(mismatched, id)
+		}
+	}
+	sort.Slice(mismatched, func(i, j int) bool { return mismatched[i] < mismatched[j] })
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s: %d records in (%d, %d], %d accounts mismatched, %d added, %d removed\n",
+		oldSnap.table, count, oldSnap.recordID, newSnap.recordID, len(mismatched), len(added), len(balances))
+	for _, id := range added {
+		fmt.Fprintf(bw, "account %d is added\n", id)
+	}
+	for id := range balances {
+		fmt.Fprintf(bw, "account %d is removed\n", id)
+	}
+	for i, id := range mismatched {
+		fmt.Fprintf(bw, "account %d changes %d beyond its records\n", id, deltas[id])
+		if i >= maxDiffRecords {
+			continue
+		}
+		query = fmt.Sprintf("SELECT id, from_id, to_id, from_balance, to_balance, amount, tso FROM %s WHERE id > ? AND id <= ? AND (from_id = ? OR to_id = ?) ORDER BY id", recordTable)
+		err = scanRecords(ctx, db, query, func(r transferRecord) {
+			fmt.Fprintf(bw, "    record %d transfers %d(%d) -> %d(%d) amount %d at tso %d\n",
+				r.ID, r.FromID, r.FromBalance, r.ToID, r.ToBalance, r.Amount, r.TSO)
+		}, oldSnap.recordID, newSnap.recordID, id, id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(mismatched) > 0 || len(added) > 0 || len(balances) > 0 {
+		return errors.Errorf("%s and %s differ beyond the records", oldFile, newFile)
+	}
+	return nil
+}
+
+// scanRecords calls f for every record returned by query.
+func scanRecords(ctx context.Context, db *sql.DB, query string, f func(transferRecord), args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r transferRecord
+		if err = rows.Scan(&r.ID, &r.FromID, &r.ToID, &r.FromBalance, &r.ToBalance, &r.Amount, &r.TSO); err != nil {
+			return errors.Trace(err)
+		}
+		f(r)
+	}
+	return errors.Trace(rows.Err())
+}
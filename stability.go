@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// verifySnapshotStability sums the balances of the accounts table again after
+// VerifySnapshotStability in tx, the transfers committed meanwhile must not be
+// seen, so the sum must still be first.
+func (c *BankCase) verifySnapshotStability(ctx context.Context, tx *sql.Tx, index string, first *big.Int) error {
+	if err := c.delay(ctx, c.cfg.VerifySnapshotStability); err != nil {
+		return err
+	}
+	var sum []byte
+	query := fmt.Sprintf("select %ssum(balance) as total from %s", c.verifyHint(), c.accountsTable(index))
+	if err := tx.QueryRowContext(ctx, query).Scan(&sum); err != nil {
+		return errors.Trace(err)
+	}
+	second, err := parseBigInt(sum)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if second.Cmp(first) == 0 {
+		return nil
+	}
+	var tso uint64
+	if TiDBDatabase {
+		if err = tx.QueryRowContext(ctx, "select @@tidb_current_ts").Scan(&tso); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return mismatchError{errors.Errorf("%s total is %d then %d after %s in one transaction at tso %d",
+		c.accountsTable(index), first, second, c.cfg.VerifySnapshotStability, tso)}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// errGCTooEarly is the TiDB error of reading a snapshot older than the GC safe point.
+const errGCTooEarly = 9006
+
+// verifyStaleRead sums the balances of every table as of StaleRead ago by the
+// stale read of TiDB, the money is conserved at any time. The snapshot older
+// than since is skipped, the tables may be initializing then, so is the
+// snapshot which is garbage collected or before the tables are created.
+func (c *BankCase) verifyStaleRead(ctx context.Context, db *sql.DB, since time.Time) {
+	if time.Since(since) < c.cfg.StaleRead {
+		return
+	}
+	for i := 0; i < c.cfg.TableNum; i++ {
+		table, numAccounts := c.accountsTable(tableIndex(i)), c.cfg.NumAccounts[i]
+		count, total, err := c.sumAsOf(ctx, db, table, fmt.Sprintf("now(6) - interval %d microsecond", c.cfg.StaleRead/time.Microsecond))
+		if isMySQLError(err, errGCTooEarly) || IsErrTableNotExists(err) {
+			log.Warnf("[%s] stale read %s as of %s ago is unavailable, skip it: %v", c, table, c.cfg.StaleRead, err)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("[%s] stale read %s error %v", c, table, err)
+			}
+			return
+		}
+		if check := c.initialSum(numAccounts); !c.countMatches(count, numAccounts) || total.Cmp(check) != 0 {
+			c.stop(invariantViolation("stale read %s as of %s ago got %d accounts with total %d, want %d accounts with total %d",
+				table, c.cfg.StaleRead, count, total, numAccounts, check))
+			return
+		}
+		log.Infof("[%s] stale read verify %s as of %s ago success", c, table, c.cfg.StaleRead)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+)
+
+// StartStatusServer serves the liveness and readiness probes and the metrics
+// of the bank case on addr, it shuts the server down when ctx is done or the
+// bank case is closed.
+func StartStatusServer(ctx context.Context, addr string, c *BankCase) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&c.stopped) != 0 {
+			http.Error(w, "stopped", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&c.ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	c.mu.Lock()
+	c.statusServer = srv
+	c.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Infof("[bank] status server listens on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("[bank] status server error %v", err)
+	}
+}
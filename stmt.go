@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+// transferStmts holds the statements a transfer runs on one accounts table.
+// The SQL uses ? placeholders, it is either prepared or has its arguments
+// inlined before execution.
+type transferStmts struct {
+	accountsTable string
+
+	selectSQL string
+	// selectOneSQL locks one account, it's used if the accounts are locked in order
+	selectOneSQL string
+	updateSQL    string
+	insertSQL    string
+	// trackUpdatedAt sets updated_at to the tso in the update
+	trackUpdatedAt bool
+	// recordFanout is the number of the rows insertSQL inserts
+	recordFanout int
+	// compositeKey keys the accounts by (id, shard)
+	compositeKey bool
+
+	// only set in prepared mode
+	selectStmt    *sql.Stmt
+	selectOneStmt *sql.Stmt
+	updateStmt    *sql.Stmt
+	insertStmt    *sql.Stmt
+}
+
+// Lock modes of the select of transfers.
+const (
+	// LockForUpdate blocks on the rows locked by other transactions
+	LockForUpdate = "for-update"
+	// LockForUpdateNowait fails at once on the rows locked by other transactions
+	LockForUpdateNowait = "for-update-nowait"
+	// LockNone doesn't lock, the optimistic transactions of TiDB detect the
+	// write conflicts at commit and the conflicting ones are retried
+	LockNone = "none"
+)
+
+// Lock orders of the accounts of transfers.
+const (
+	// LockOrderNone locks both accounts in one select, the order is up to the database
+	LockOrderNone = "none"
+	// LockOrderFromTo locks the from account then the to account, the
+	// pessimistic transactions may deadlock
+	LockOrderFromTo = "from-to"
+	// LockOrderAscending locks the accounts in ascending id order, which never deadlocks
+	LockOrderAscending = "ascending"
+)
+
+// lockClauses are the clauses of the lock modes.
+var lockClauses = map[string]string{
+	LockForUpdate:       "FOR UPDATE",
+	LockForUpdateNowait: "FOR UPDATE NOWAIT",
+	LockNone:            "",
+}
+
+func newTransferStmts(accountsTable, recordTable string, trackUpdatedAt bool, lockMode string, recordFanout int, compositeKey bool) *transferStmts {
+	var setUpdatedAt string
+	if trackUpdatedAt {
+		setUpdatedAt = ", updated_at = ?"
+	}
+	insertSQL := fmt.Sprintf(`
+INSERT INTO %s (from_id, to_id, from_balance, to_balance, amount, tso)
+    VALUES (?, ?, ?, ?, ?, ?)`, recordTable)
+	if recordFanout > 1 {
+		values := make([]string, recordFanout)
+		for i := range values {
+			values[i] = fmt.Sprintf("(?, ?, ?, ?, ?, ?, %d)", i)
+		}
+		insertSQL = fmt.Sprintf(`
+INSERT INTO %s (from_id, to_id, from_balance, to_balance, amount, tso, seq)
+    VALUES %s`, recordTable, strings.Join(values, ", "))
+	} else {
+		recordFanout = 1
+	}
+	whereTwo, whereOne := "id IN (?, ?)", "id = ?"
+	if compositeKey {
+		whereTwo, whereOne = "(id, shard) IN ((?, ?), (?, ?))", "id = ? AND shard = ?"
+	}
+	return &transferStmts{
+		accountsTable: accountsTable,
+		selectSQL:     fmt.Sprintf("SELECT id, balance FROM %s WHERE %s %s", accountsTable, whereTwo, lockClauses[lockMode]),
+		selectOneSQL:  fmt.Sprintf("SELECT id, balance FROM %s WHERE %s %s", accountsTable, whereOne, lockClauses[lockMode]),
+		updateSQL: fmt.Sprintf(`
+UPDATE %s
+  SET balance = CASE id WHEN ? THEN ? WHEN ? THEN ? END%s
+  WHERE %s
+`, accountsTable, setUpdatedAt, whereTwo),
+		insertSQL:      insertSQL,
+		trackUpdatedAt: trackUpdatedAt,
+		recordFanout:   recordFanout,
+		compositeKey:   compositeKey,
+	}
+}
+
+// keyArgs returns the args of the keys of the accounts ids in the WHERE clauses.
+func (s *transferStmts) keyArgs(ids ...int) []interface{} {
+	args := make([]interface{}, 0, 2*len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+		if s.compositeKey {
+			args = append(args, accountShard(id))
+		}
+	}
+	return args
+}
+
+// updateArgs returns the args of updateSQL which transfers amount from one account to another.
+func (s *transferStmts) updateArgs(from, to int, fromBalance, toBalance uint64, amount int, tso uint64) []interface{} {
+	args := []interface{}{to, toBalance + uint64(amount), from, fromBalance - uint64(amount)}
+	if s.trackUpdatedAt {
+		args = append(args, tso)
+	}
+	return append(args, s.keyArgs(from, to)...)
+}
+
+// insertArgs returns the args of insertSQL which records a transfer.
+func (s *transferStmts) insertArgs(from, to int, fromBalance, toBalance uint64, amount int, tso uint64) []interface{} {
+	args := make([]interface{}, 0, 6*s.recordFanout)
+	for i := 0; i < s.recordFanout; i++ {
+		args = append(args, from, to, fromBalance, toBalance, amount, tso)
+	}
+	return args
+}
+
+// prepare prepares the statements on db. database/sql prepares them again
+// on every connection they are used on, so they survive connection recycling.
+func (s *transferStmts) prepare(ctx context.Context, db *sql.DB) error {
+	var err error
+	if s.selectStmt, err = db.PrepareContext(ctx, s.selectSQL); err != nil {
+		return errors.Trace(err)
+	}
+	if s.selectOneStmt, err = db.PrepareContext(ctx, s.selectOneSQL); err != nil {
+		return errors.Trace(err)
+	}
+	if s.updateStmt, err = db.PrepareContext(ctx, s.updateSQL); err != nil {
+		return errors.Trace(err)
+	}
+	if s.insertStmt, err = db.PrepareContext(ctx, s.insertSQL); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *transferStmts) close() {
+	for _, stmt := range []*sql.Stmt{s.selectStmt, s.selectOneStmt, s.updateStmt, s.insertStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	s.selectStmt, s.selectOneStmt, s.updateStmt, s.insertStmt = nil, nil, nil, nil
+}
+
+func (s *transferStmts) query(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt != nil {
+		return tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+	}
+	return tx.QueryContext(ctx, bindArgs(query, args...))
+}
+
+func (s *transferStmts) exec(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, query string, args ...interface{}) (sql.Result, error) {
+	if stmt != nil {
+		return tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	}
+	return tx.ExecContext(ctx, bindArgs(query, args...))
+}
+
+// bindArgs inlines the numeric args into query in place of the ? placeholders.
+func bindArgs(query string, args ...interface{}) string {
+	return fmt.Sprintf(strings.Replace(query, "?", "%v", -1), args...)
+}
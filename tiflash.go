@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// errNoAccessPath is the TiDB error of reading a table without a replica of
+// the isolation read engines, the table has no TiFlash replica.
+const errNoAccessPath = 1815
+
+// verifyTiFlash sums the balances of every table on TiFlash and on TiKV in one
+// transaction, both sums read the same snapshot so they must be equal. The
+// tables without TiFlash replicas are skipped.
+func (c *BankCase) verifyTiFlash(ctx context.Context, db *sql.DB) {
+	for i := 0; i < c.cfg.TableNum; i++ {
+		table := c.accountsTable(tableIndex(i))
+		tiflash, tikv, err := c.sumOnEngines(ctx, db, table)
+		if isMySQLError(err, errNoAccessPath) {
+			log.Warnf("[%s] %s has no TiFlash replica, skip the TiFlash verify: %v", c, table, err)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("[%s] TiFlash verify %s error %v", c, table, err)
+			}
+			return
+		}
+		if tiflash != tikv {
+			c.stop(invariantViolation("%s sums %s on TiFlash but %s on TiKV at the same snapshot", table, tiflash, tikv))
+			return
+		}
+		log.Infof("[%s] TiFlash verify %s success", c, table)
+	}
+}
+
+// sumOnEngines returns the sums of the balances of table on TiFlash and on
+// TiKV. The read engines are session variables, so a pinned connection is
+// used and restored before it returns to the pool.
+func (c *BankCase) sumOnEngines(ctx context.Context, db *sql.DB, table string) (tiflash, tikv string, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	defer conn.Close()
+	defer conn.ExecContext(context.Background(), "set @@session.tidb_isolation_read_engines = default")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("select cast(ifnull(sum(balance), 0) as char) from %s", table)
+	for _, sum := range []struct {
+		engines string
+		dest    *string
+	}{{"tiflash", &tiflash}, {"tikv", &tikv}} {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("set @@session.tidb_isolation_read_engines = '%s'", sum.engines)); err != nil {
+			return "", "", errors.Trace(err)
+		}
+		if err = tx.QueryRowContext(ctx, query).Scan(sum.dest); err != nil {
+			return "", "", errors.Annotatef(err, "sum on %s", sum.engines)
+		}
+	}
+	return tiflash, tikv, nil
+}
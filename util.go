@@ -22,31 +22,48 @@ func OpenDB(dsn string, maxIdleConns int) (*sql.DB, error) {
 	return db, nil
 }
 
-// MustExec must execute sql or fatal
-func MustExec(db *sql.DB, query string, args ...interface{}) sql.Result {
-	r, err := db.Exec(query, args...)
-	if err != nil {
-		log.Fatalf("exec %s err %v", query, err)
-	}
-	return r
-}
-
 // RunWithRetry tries to run func in specified count
 func RunWithRetry(ctx context.Context, retryCnt int, interval time.Duration, f func() error) error {
+	_, err := RunWithRetryAttempts(ctx, retryCnt, interval, f)
+	return err
+}
+
+// RunWithRetryAttempts is RunWithRetry which also returns the number of the
+// attempts to run func.
+func RunWithRetryAttempts(ctx context.Context, retryCnt int, interval time.Duration, f func() error) (int, error) {
 	var (
-		err error
+		err      error
+		attempts int
 	)
 	for i := 0; retryCnt < 0 || i < retryCnt; i++ {
+		attempts++
 		err = f()
 		if err == nil {
-			return nil
+			return attempts, nil
 		}
 
+		timer := time.NewTimer(interval)
 		select {
 		case <-ctx.Done():
-			return nil
-		case <-time.After(interval):
+			timer.Stop()
+			return attempts, nil
+		case <-timer.C:
 		}
 	}
-	return errors.Trace(err)
+	return attempts, errors.Trace(err)
+}
+
+// SupportSavepoint checks whether the database supports savepoints
+func SupportSavepoint(db *sql.DB) bool {
+	tx, err := db.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SAVEPOINT sp1"); err != nil {
+		return false
+	}
+	_, err = tx.Exec("ROLLBACK TO SAVEPOINT sp1")
+	return err == nil
 }
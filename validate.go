@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// identRegexp matches the identifiers which need no quoting.
+var identRegexp = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// Validate checks the config before the bank case starts, it returns all the
+// problems found in one error.
+func (cfg *Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch cfg.Mode {
+	case modeInit, modeRun, modeInitAndRun, modeVerifyOnce, modeDumpRecords, modeCleanup, modeSnapshotDiff, modeProbe, modeReplayVerify:
+	default:
+		addf("unknown mode %s", cfg.Mode)
+	}
+
+	// tables and workers
+	if cfg.TableNum < 0 {
+		addf("tables %d is negative", cfg.TableNum)
+	}
+	tables := cfg.TableNum
+	if tables < 1 {
+		tables = 1
+	}
+	if len(cfg.NumAccounts) != 1 && len(cfg.NumAccounts) != tables {
+		addf("got %d numbers of accounts for %d tables", len(cfg.NumAccounts), tables)
+	}
+	for _, n := range cfg.NumAccounts {
+		// a transfer needs two different accounts
+		if n < 2 {
+			addf("%d accounts are too few", n)
+		}
+	}
+	if cfg.Concurrency <= 0 {
+		addf("concurrency %d must be positive", cfg.Concurrency)
+	}
+	// RunWithRetry doesn't run at all with 0, negative is unlimited
+	if cfg.RetryLimit == 0 {
+		addf("retry-limit must not be 0, use a negative value for unlimited retries")
+	}
+	if !identRegexp.MatchString(cfg.TablePrefix) {
+		addf("table-prefix %s may only contain letters, digits and underscores", cfg.TablePrefix)
+	}
+	if !identRegexp.MatchString(cfg.TableCharset) || !identRegexp.MatchString(cfg.TableCollation) {
+		addf("table-charset %s and table-collation %s may only contain letters, digits and underscores", cfg.TableCharset, cfg.TableCollation)
+	}
+	// the multi-byte remarks have 4 bytes characters, the server default
+	// charset may not store them
+	if cfg.MultibyteRemark && cfg.TableCharset != "utf8mb4" {
+		addf("multibyte-remark needs table-charset utf8mb4")
+	}
+	switch cfg.IDScheme {
+	case IDSequential, IDBitReversed:
+	default:
+		addf("unknown id scheme %s", cfg.IDScheme)
+	}
+	switch cfg.ClusteredIndex {
+	case ClusteredIndexDefault, ClusteredIndexOn, ClusteredIndexOff:
+	default:
+		addf("unknown clustered index %s", cfg.ClusteredIndex)
+	}
+	if cfg.AccountsDDL != "" {
+		if _, err := parseAccountsDDL(cfg.AccountsDDL); err != nil {
+			addf("schema-file: %v", err)
+		}
+		// only the columns of accountsDDLColumns are checked in the custom DDL
+		if cfg.TrackUpdatedAt || cfg.CompositeKey || cfg.GeneratedColumn || cfg.WithIndex {
+			addf("schema-file conflicts with track-updated-at, composite-key, generated-column and with-index")
+		}
+	}
+	if _, ok := lockClauses[cfg.LockMode]; !ok {
+		addf("unknown lock mode %s", cfg.LockMode)
+	}
+	// the transfers write the balances they read, the pessimistic
+	// transactions would lose updates without locking the reads
+	if cfg.LockMode == LockNone && (cfg.Pessimistic || cfg.PessimisticRatio > 0 || cfg.WriteSkewLock) {
+		addf("lock-mode %s needs optimistic transactions and conflicts with write-skew-lock", LockNone)
+	}
+	switch cfg.LockOrder {
+	case LockOrderNone, LockOrderFromTo, LockOrderAscending:
+	default:
+		addf("unknown lock order %s", cfg.LockOrder)
+	}
+	switch cfg.OnMismatch {
+	case OnMismatchFatal, OnMismatchPause, OnMismatchContinue:
+	default:
+		addf("unknown on-mismatch action %s", cfg.OnMismatch)
+	}
+	// the other actions stop on any drift
+	if cfg.MaxDrift < 0 || (cfg.MaxDrift > 0 && cfg.OnMismatch != OnMismatchContinue) {
+		addf("max-drift %d must not be negative and needs on-mismatch %s", cfg.MaxDrift, OnMismatchContinue)
+	}
+	if cfg.DebugVerifyEach {
+		for _, n := range cfg.NumAccounts {
+			if n > maxDebugVerifyAccounts {
+				addf("debug-verify-each refuses to verify %d accounts after every transfer, more than %d", n, maxDebugVerifyAccounts)
+			}
+		}
+	}
+	if cfg.InitMethod != InitInsert && cfg.InitMethod != InitLoadData {
+		addf("unknown init method %s", cfg.InitMethod)
+	}
+	switch cfg.ReconcileTables {
+	case ReconcileWarn, ReconcileVerify, ReconcileDrop:
+	default:
+		addf("unknown reconcile policy %s", cfg.ReconcileTables)
+	}
+
+	// durations and rates
+	if cfg.Interval <= 0 {
+		addf("interval %s must be positive", cfg.Interval)
+	}
+	if cfg.VerifyTimeout < 0 || cfg.Warmup < 0 || cfg.SlowTxnThreshold < 0 || cfg.ConnectTimeout < 0 || cfg.PostRunVerifyWindow < 0 {
+		addf("verify-timeout %s, warmup %s, slow-txn-threshold %s, connect-timeout %s and post-run-verify-window %s must not be negative",
+			cfg.VerifyTimeout, cfg.Warmup, cfg.SlowTxnThreshold, cfg.ConnectTimeout, cfg.PostRunVerifyWindow)
+	}
+	if cfg.EnableLongTxn && (cfg.MinDelay <= 0 || cfg.MaxDelay <= 0 || cfg.MinDelay >= cfg.MaxDelay) {
+		addf("invalid delay range [%s, %s), both must be positive and min must be less than max", cfg.MinDelay, cfg.MaxDelay)
+	}
+	if cfg.VerifyRate < 0 || cfg.RateLimit < 0 {
+		addf("verify-rate %v and rate-limit %v must not be negative", cfg.VerifyRate, cfg.RateLimit)
+	}
+	if cfg.PoolStatsInterval < 0 || cfg.KeepaliveInterval < 0 {
+		addf("pool-stats-interval %s and keepalive-interval %s must not be negative", cfg.PoolStatsInterval, cfg.KeepaliveInterval)
+	}
+	if cfg.InitLogEvery < 0 {
+		addf("init-log-every %d is negative", cfg.InitLogEvery)
+	}
+	if cfg.WriteSkewPairs < 0 {
+		addf("write-skew-pairs %d is negative", cfg.WriteSkewPairs)
+	}
+	if cfg.VerifySnapshotStability < 0 || (cfg.VerifySnapshotStability > 0 && cfg.VerifyMode == VerifyRangeSample) {
+		addf("verify-snapshot-stability %s must not be negative and conflicts with verify-mode %s", cfg.VerifySnapshotStability, VerifyRangeSample)
+	}
+	if cfg.VerifyRetry < 0 {
+		addf("verify-retry %d is negative", cfg.VerifyRetry)
+	}
+	// the hint is put in a comment, TiDB and MySQL 5.7+ support the hints
+	if strings.Contains(cfg.VerifyHint, "*/") || strings.Contains(cfg.VerifyHint, "/*") {
+		addf("verify-hint %s must not contain comments, give the hints without /*+ and */", cfg.VerifyHint)
+	}
+	if cfg.StaleRead < 0 {
+		addf("stale-read %s is negative", cfg.StaleRead)
+	}
+	if cfg.MicroVerifyEvery < 0 {
+		addf("micro-verify-every %d is negative", cfg.MicroVerifyEvery)
+	}
+
+	// transfers
+	if cfg.TxnSize < 0 {
+		addf("txn-size %d is negative", cfg.TxnSize)
+	}
+	if cfg.AmountMin < 0 || cfg.AmountMin > cfg.AmountMax {
+		addf("invalid amount range [%d, %d]", cfg.AmountMin, cfg.AmountMax)
+	}
+	if cfg.AmountDist != AmountUniform && cfg.AmountDist != AmountNormal {
+		addf("unknown amount distribution %s", cfg.AmountDist)
+	}
+	if !cfg.UnsignedBalance && cfg.InitialBalance > math.MaxInt64 {
+		addf("initial-balance %d overflows BIGINT, use unsigned-balance", cfg.InitialBalance)
+	}
+	if cfg.ChaosKillConnRatio < 0 || cfg.ChaosKillConnRatio > 1 {
+		addf("chaos-kill-conn-ratio %v is out of [0, 1]", cfg.ChaosKillConnRatio)
+	}
+	if cfg.ReadRatio < 0 || cfg.ReadRatio >= 1 {
+		addf("read-ratio %v is out of [0, 1)", cfg.ReadRatio)
+	}
+	if cfg.PessimisticRatio > 1 {
+		addf("pessimistic-ratio %v is larger than 1", cfg.PessimisticRatio)
+	}
+	for _, op := range cfg.ChaosDDLOps {
+		if op != ChaosDDLColumn && op != ChaosDDLIndex {
+			addf("unknown chaos DDL %s", op)
+		}
+	}
+	if len(cfg.ChaosDDLOps) > 0 && cfg.ChaosDDLInterval <= 0 {
+		addf("chaos-ddl-interval must be positive")
+	}
+
+	// the record table
+	if cfg.RecordRetention < 0 {
+		addf("record-retention %d is negative", cfg.RecordRetention)
+	}
+	// the record table is shared by all accounts tables
+	if cfg.TrackUpdatedAt && tables > 1 {
+		addf("track-updated-at needs tables 1")
+	}
+	// the checks read the record table
+	if cfg.DisableRecord && (cfg.TrackUpdatedAt || cfg.VerifyMode == VerifyRangeSample || cfg.RecordRetention > 0 || cfg.VerifyLostUpdate || cfg.Mode == modeDumpRecords) {
+		addf("disable-record conflicts with track-updated-at, verify-mode %s, record-retention, verify-lost-update and mode %s", VerifyRangeSample, modeDumpRecords)
+	}
+	// the checks which sum or replay the records count a transfer once
+	if cfg.RecordFanout < 0 {
+		addf("record-fanout %d is negative", cfg.RecordFanout)
+	}
+	if cfg.RecordFanout > 1 && (cfg.DisableRecord || cfg.VerifyMode == VerifyRangeSample || cfg.VerifyLostUpdate || cfg.StateSnapshotInterval > 0 || cfg.Mode == modeSnapshotDiff) {
+		addf("record-fanout conflicts with disable-record, verify-mode %s, verify-lost-update and state snapshots", VerifyRangeSample)
+	}
+	// the churn moves money without records
+	if cfg.AccountChurn < 0 || cfg.AccountChurn >= 1 {
+		addf("account-churn %v must be in [0, 1)", cfg.AccountChurn)
+	}
+	if cfg.AccountChurn > 0 && (cfg.TrackUpdatedAt || cfg.VerifyMode == VerifyRangeSample || cfg.VerifyLostUpdate || cfg.VerifyTSOOrder || cfg.StateSnapshotInterval > 0 || cfg.Mode == modeSnapshotDiff) {
+		addf("account-churn conflicts with track-updated-at, verify-mode %s, verify-lost-update, verify-tso-order and state snapshots", VerifyRangeSample)
+	}
+	// the records lag behind the accounts
+	if cfg.RecordAsync && (cfg.DisableRecord || cfg.RecordFanout > 1 || cfg.TrackUpdatedAt || cfg.VerifyMode == VerifyRangeSample || cfg.VerifyLostUpdate || cfg.VerifyTSOOrder || cfg.StateSnapshotInterval > 0) {
+		addf("record-async conflicts with disable-record, record-fanout, track-updated-at, verify-mode %s, verify-lost-update, verify-tso-order and state snapshots", VerifyRangeSample)
+	}
+	// the pruned records can't be replayed
+	if cfg.VerifyLostUpdate && (tables > 1 || cfg.RecordRetention > 0) {
+		addf("verify-lost-update needs tables 1 and conflicts with record-retention")
+	}
+	// the start ts of pessimistic transactions may be out of their commit order
+	if cfg.VerifyTSOOrder && (tables > 1 || cfg.RecordRetention > 0 || cfg.DisableRecord || cfg.RecordFanout > 1 || cfg.Pessimistic || cfg.PessimisticRatio > 0) {
+		addf("verify-tso-order needs tables 1, all rows of the record table and optimistic transactions")
+	}
+	// the snapshots are diffed against the records of a single table
+	if cfg.StateSnapshotInterval < 0 {
+		addf("state-snapshot-interval %s is negative", cfg.StateSnapshotInterval)
+	}
+	if cfg.StateSnapshotInterval > 0 || cfg.Mode == modeSnapshotDiff {
+		if tables > 1 || cfg.DisableRecord || cfg.RecordRetention > 0 {
+			addf("state snapshots need tables 1 and all rows of the record table, they conflict with disable-record and record-retention")
+		}
+	}
+	// the replay counts every transfer once from the initial balances
+	if cfg.Mode == modeReplayVerify && (tables > 1 || cfg.DisableRecord || cfg.RecordRetention > 0 || cfg.RecordFanout > 1 || cfg.AccountChurn > 0) {
+		addf("mode %s needs tables 1 and all rows of the record table, it conflicts with disable-record, record-retention, record-fanout and account-churn", modeReplayVerify)
+	}
+	if cfg.StateSnapshotInterval > 0 {
+		for _, n := range cfg.NumAccounts {
+			if n > maxSnapshotAccounts {
+				addf("state snapshots refuse to snapshot %d accounts, more than %d", n, maxSnapshotAccounts)
+			}
+		}
+	}
+	if cfg.Mode == modeSnapshotDiff && len(cfg.SnapshotDiff) != 2 {
+		addf("mode %s needs the old and new snapshot files in snapshot-diff", modeSnapshotDiff)
+	}
+	if cfg.Mode == modeDumpRecords && cfg.DumpFormat != dumpCSV && cfg.DumpFormat != dumpJSON {
+		addf("unknown dump format %s", cfg.DumpFormat)
+	}
+
+	// verify
+	switch cfg.VerifyMode {
+	case VerifyFullSum:
+	case VerifyRangeSample:
+		if tables > 1 || cfg.VerifySampleSize <= 0 {
+			addf("verify mode %s needs tables 1 and a positive verify-sample-size", cfg.VerifyMode)
+		}
+		// the pruned records can't be summed
+		if cfg.RecordRetention > 0 {
+			addf("verify mode %s needs all rows of the record table, it conflicts with record-retention", cfg.VerifyMode)
+		}
+	default:
+		addf("unknown verify mode %s", cfg.VerifyMode)
+	}
+
+	// connection pool
+	if cfg.MaxOpenConns < 0 || cfg.MaxIdleConns < 0 || cfg.ConnMaxLifetime < 0 {
+		addf("max-open-conns %d, max-idle-conns %d and conn-max-lifetime %s must not be negative",
+			cfg.MaxOpenConns, cfg.MaxIdleConns, cfg.ConnMaxLifetime)
+	}
+	if cfg.ConnLifetimeJitter < 0 || (cfg.ConnLifetimeJitter > 0 && (cfg.ConnMaxLifetime == 0 || cfg.ConnLifetimeJitter > cfg.ConnMaxLifetime)) {
+		addf("conn-lifetime-jitter %s must not be negative, it needs conn-max-lifetime and must not be larger than conn-max-lifetime %s",
+			cfg.ConnLifetimeJitter, cfg.ConnMaxLifetime)
+	}
+	for _, addr := range cfg.Addrs {
+		if addr == "" {
+			addf("empty address in addrs %q", strings.Join(cfg.Addrs, ","))
+			break
+		}
+	}
+	if cfg.MaxOpenConns > 0 && cfg.MaxIdleConns > cfg.MaxOpenConns {
+		addf("max-idle-conns %d is larger than max-open-conns %d", cfg.MaxIdleConns, cfg.MaxOpenConns)
+	}
+	// the long-term transactions hold their connections for up to MaxDelay,
+	// verify would wait for them without spare connections
+	if cfg.EnableLongTxn && cfg.MaxOpenConns > 0 && cfg.MaxOpenConns <= cfg.Concurrency {
+		addf("long-txn needs max-open-conns %d larger than concurrency %d", cfg.MaxOpenConns, cfg.Concurrency)
+	}
+	// so do the pinned connections for the lifetime of the workers
+	if cfg.PinConn && cfg.MaxOpenConns > 0 && cfg.MaxOpenConns <= cfg.Concurrency {
+		addf("pin-conn needs max-open-conns %d larger than concurrency %d", cfg.MaxOpenConns, cfg.Concurrency)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a config which passes Validate, the cases break one field of it.
+func validConfig() Config {
+	return Config{
+		Mode:            modeInitAndRun,
+		TableNum:        1,
+		NumAccounts:     []int{100},
+		Concurrency:     10,
+		RetryLimit:      10,
+		Interval:        time.Second,
+		IDScheme:        IDSequential,
+		ClusteredIndex:  ClusteredIndexDefault,
+		LockMode:        LockForUpdate,
+		LockOrder:       LockOrderNone,
+		OnMismatch:      OnMismatchFatal,
+		InitMethod:      InitInsert,
+		ReconcileTables: ReconcileWarn,
+		AmountMin:       1,
+		AmountMax:       10,
+		AmountDist:      AmountUniform,
+		InitialBalance:  1000,
+		VerifyMode:      VerifyFullSum,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := validConfig()
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("the valid config fails to validate: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// want is a part of the problem reported
+		want string
+	}{
+		{"mode", func(cfg *Config) { cfg.Mode = "unknown" }, "unknown mode"},
+		{"negative tables", func(cfg *Config) { cfg.TableNum = -1 }, "tables -1 is negative"},
+		{"numbers of accounts", func(cfg *Config) { cfg.TableNum, cfg.NumAccounts = 3, []int{10, 10} }, "numbers of accounts for 3 tables"},
+		{"zero accounts", func(cfg *Config) { cfg.NumAccounts = []int{0} }, "0 accounts are too few"},
+		{"one account", func(cfg *Config) { cfg.NumAccounts = []int{1} }, "1 accounts are too few"},
+		{"zero concurrency", func(cfg *Config) { cfg.Concurrency = 0 }, "concurrency 0 must be positive"},
+		{"negative concurrency", func(cfg *Config) { cfg.Concurrency = -1 }, "concurrency -1 must be positive"},
+		{"zero retry limit", func(cfg *Config) { cfg.RetryLimit = 0 }, "retry-limit must not be 0"},
+		{"table prefix", func(cfg *Config) { cfg.TablePrefix = "a-b" }, "table-prefix"},
+		{"table charset", func(cfg *Config) { cfg.TableCharset = "utf8;" }, "table-charset"},
+		{"schema file", func(cfg *Config) { cfg.AccountsDDL = "create table {{.Table}}" }, "accounts DDL doesn't have column"},
+		{"schema file with index", func(cfg *Config) {
+			cfg.AccountsDDL = "create table {{.Table}} (id bigint primary key, balance bigint, remark varchar(128))"
+			cfg.WithIndex = true
+		}, "schema-file conflicts with"},
+		{"schema file composite key", func(cfg *Config) {
+			cfg.AccountsDDL = "create table {{.Table}} (id bigint primary key, balance bigint, remark varchar(128))"
+			cfg.CompositeKey = true
+		}, "schema-file conflicts with"},
+		{"multibyte remark charset", func(cfg *Config) { cfg.MultibyteRemark, cfg.TableCharset = true, "utf8" }, "multibyte-remark needs table-charset utf8mb4"},
+		{"multibyte remark default charset", func(cfg *Config) { cfg.MultibyteRemark = true }, "multibyte-remark needs table-charset utf8mb4"},
+		{"id scheme", func(cfg *Config) { cfg.IDScheme = "random" }, "unknown id scheme"},
+		{"lock mode", func(cfg *Config) { cfg.LockMode = "share" }, "unknown lock mode"},
+		{"lock none pessimistic", func(cfg *Config) { cfg.LockMode, cfg.Pessimistic = LockNone, true }, "needs optimistic transactions"},
+		{"lock order", func(cfg *Config) { cfg.LockOrder = "random" }, "unknown lock order"},
+		{"on mismatch", func(cfg *Config) { cfg.OnMismatch = "ignore" }, "unknown on-mismatch action"},
+		{"max drift", func(cfg *Config) { cfg.MaxDrift = 10 }, "max-drift 10"},
+		{"debug verify each", func(cfg *Config) { cfg.DebugVerifyEach, cfg.NumAccounts = true, []int{maxDebugVerifyAccounts + 1} }, "debug-verify-each"},
+		{"init method", func(cfg *Config) { cfg.InitMethod = "copy" }, "unknown init method"},
+		{"reconcile", func(cfg *Config) { cfg.ReconcileTables = "ignore" }, "unknown reconcile policy"},
+		{"zero interval", func(cfg *Config) { cfg.Interval = 0 }, "interval 0s must be positive"},
+		{"negative interval", func(cfg *Config) { cfg.Interval = -time.Second }, "interval -1s must be positive"},
+		{"negative verify timeout", func(cfg *Config) { cfg.VerifyTimeout = -time.Second }, "verify-timeout -1s"},
+		{"negative warmup", func(cfg *Config) { cfg.Warmup = -time.Second }, "warmup -1s"},
+		{"delay range", func(cfg *Config) { cfg.EnableLongTxn, cfg.MinDelay, cfg.MaxDelay = true, time.Minute, time.Second }, "invalid delay range"},
+		{"negative rate limit", func(cfg *Config) { cfg.RateLimit = -1 }, "rate-limit -1"},
+		{"negative pool stats interval", func(cfg *Config) { cfg.PoolStatsInterval = -time.Second }, "pool-stats-interval -1s"},
+		{"negative keepalive interval", func(cfg *Config) { cfg.KeepaliveInterval = -time.Second }, "keepalive-interval -1s"},
+		{"negative init log every", func(cfg *Config) { cfg.InitLogEvery = -1 }, "init-log-every -1"},
+		{"negative write skew pairs", func(cfg *Config) { cfg.WriteSkewPairs = -1 }, "write-skew-pairs -1"},
+		{"negative verify retry", func(cfg *Config) { cfg.VerifyRetry = -1 }, "verify-retry -1"},
+		{"verify hint", func(cfg *Config) { cfg.VerifyHint = "/*+ x */" }, "verify-hint"},
+		{"negative stale read", func(cfg *Config) { cfg.StaleRead = -time.Second }, "stale-read -1s"},
+		{"negative micro verify every", func(cfg *Config) { cfg.MicroVerifyEvery = -1 }, "micro-verify-every -1"},
+		{"negative txn size", func(cfg *Config) { cfg.TxnSize = -1 }, "txn-size -1"},
+		{"amount range", func(cfg *Config) { cfg.AmountMin, cfg.AmountMax = 10, 1 }, "invalid amount range"},
+		{"amount distribution", func(cfg *Config) { cfg.AmountDist = "zipf" }, "unknown amount distribution"},
+		{"initial balance", func(cfg *Config) { cfg.InitialBalance = 1 << 63 }, "overflows BIGINT"},
+		{"chaos kill conn ratio", func(cfg *Config) { cfg.ChaosKillConnRatio = 2 }, "chaos-kill-conn-ratio"},
+		{"read ratio", func(cfg *Config) { cfg.ReadRatio = 1 }, "read-ratio"},
+		{"pessimistic ratio", func(cfg *Config) { cfg.PessimisticRatio = 2 }, "pessimistic-ratio"},
+		{"chaos DDL", func(cfg *Config) { cfg.ChaosDDLOps = []string{"table"} }, "unknown chaos DDL"},
+		{"chaos DDL interval", func(cfg *Config) { cfg.ChaosDDLOps = []string{ChaosDDLColumn} }, "chaos-ddl-interval"},
+		{"negative record retention", func(cfg *Config) { cfg.RecordRetention = -1 }, "record-retention -1"},
+		{"track updated at", func(cfg *Config) { cfg.TrackUpdatedAt, cfg.TableNum = true, 2 }, "track-updated-at needs tables 1"},
+		{"disable record", func(cfg *Config) { cfg.DisableRecord, cfg.VerifyLostUpdate = true, true }, "disable-record conflicts"},
+		{"negative record fanout", func(cfg *Config) { cfg.RecordFanout = -1 }, "record-fanout -1"},
+		{"account churn", func(cfg *Config) { cfg.AccountChurn = 1 }, "account-churn 1"},
+		{"record async", func(cfg *Config) { cfg.RecordAsync, cfg.DisableRecord = true, true }, "record-async conflicts"},
+		{"negative state snapshot interval", func(cfg *Config) { cfg.StateSnapshotInterval = -time.Second }, "state-snapshot-interval -1s"},
+		{"replay verify", func(cfg *Config) { cfg.Mode, cfg.TableNum = modeReplayVerify, 2 }, "mode replay-verify needs tables 1"},
+		{"snapshot diff", func(cfg *Config) { cfg.Mode = modeSnapshotDiff }, "needs the old and new snapshot files"},
+		{"dump format", func(cfg *Config) { cfg.Mode, cfg.DumpFormat = modeDumpRecords, "xml" }, "unknown dump format"},
+		{"verify mode", func(cfg *Config) { cfg.VerifyMode = "none" }, "unknown verify mode"},
+		{"verify sample size", func(cfg *Config) { cfg.VerifyMode = VerifyRangeSample }, "positive verify-sample-size"},
+		{"negative max open conns", func(cfg *Config) { cfg.MaxOpenConns = -1 }, "max-open-conns -1"},
+		{"conn lifetime jitter", func(cfg *Config) { cfg.ConnLifetimeJitter = time.Second }, "conn-lifetime-jitter"},
+		{"empty addr", func(cfg *Config) { cfg.Addrs = []string{"a:4000", ""} }, "empty address"},
+		{"max idle conns", func(cfg *Config) { cfg.MaxOpenConns, cfg.MaxIdleConns = 10, 20 }, "max-idle-conns 20 is larger"},
+		{"long txn conns", func(cfg *Config) {
+			cfg.EnableLongTxn, cfg.MinDelay, cfg.MaxDelay, cfg.MaxOpenConns = true, time.Second, time.Minute, 10
+		}, "long-txn needs max-open-conns"},
+		{"pin conn conns", func(cfg *Config) { cfg.PinConn, cfg.MaxOpenConns = true, 10 }, "pin-conn needs max-open-conns"},
+	}
+	for _, tt := range tests {
+		cfg := validConfig()
+		tt.modify(&cfg)
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("%s: the invalid config passes", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateAggregates(t *testing.T) {
+	cfg := validConfig()
+	cfg.Concurrency, cfg.Interval, cfg.TxnSize = 0, 0, -1
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("the invalid config passes")
+	}
+	for _, want := range []string{"concurrency 0", "interval 0s", "txn-size -1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
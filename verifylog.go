@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// verifyLog appends a csv row of the sums every verify reads to a file, the
+// verifies of all tables share it.
+type verifyLog struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+// openVerifyLog opens file to append the verify rows, the header is written
+// if the file is empty.
+func openVerifyLog(file string) (*verifyLog, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+	l := &verifyLog{f: f, w: csv.NewWriter(f)}
+	if info.Size() == 0 {
+		l.w.Write([]string{"timestamp", "tso", "table", "computed_sum", "expected_sum"})
+	}
+	return l, nil
+}
+
+// write appends the sum of table read at tso and the sum expected, the tso
+// is 0 if it's not TiDB. The row is flushed at once so the file can be
+// tailed, the errors are logged only.
+func (l *verifyLog) write(tso uint64, table string, sum, expected *big.Int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write([]string{time.Now().Format(time.RFC3339Nano), strconv.FormatUint(tso, 10), table, sum.String(), expected.String()})
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		log.Warnf("[bank] write verify log %s error %v", l.f.Name(), err)
+	}
+}
+
+func (l *verifyLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		l.f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(l.f.Close())
+}
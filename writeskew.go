@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"golang.org/x/net/context"
+)
+
+// writeSkewBalance is the initial balance of the write skew accounts.
+const writeSkewBalance = 100
+
+// writeSkewErrorInterval is the wait of a write skew worker after an error.
+const writeSkewErrorInterval = 100 * time.Millisecond
+
+// The write skew accounts are paired, account 2k and 2k+1 are the k-th pair.
+// A withdrawal reads both accounts of a pair and withdraws from one of them
+// only if the pair has enough money in total, so the total must never be
+// negative. Two concurrent withdrawals from both accounts of a pair don't
+// write the same row, snapshot isolation lets both commit and overdraw the
+// pair, which is the write skew. Locking both accounts in the read prevents it.
+
+// writeSkewTable returns the name of the write skew table.
+func (c *BankCase) writeSkewTable() string {
+	return c.cfg.TablePrefix + "write_skew"
+}
+
+// initWriteSkew recreates the write skew table with WriteSkewPairs pairs.
+func (c *BankCase) initWriteSkew(ctx context.Context, db *sql.DB) error {
+	table := c.writeSkewTable()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("drop table if exists %s", table)); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("create table %s (id BIGINT PRIMARY KEY, balance BIGINT NOT NULL)", table)); err != nil {
+		return errors.Trace(err)
+	}
+	values := make([]string, 0, 2*c.cfg.WriteSkewPairs)
+	for id := 0; id < 2*c.cfg.WriteSkewPairs; id++ {
+		values = append(values, fmt.Sprintf("(%d, %d)", id, writeSkewBalance))
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf("insert into %s (id, balance) values %s", table, strings.Join(values, ", ")))
+	return errors.Trace(err)
+}
+
+// writeSkew keeps withdrawing from account side of pair until ctx is done or
+// the bank case stops, every pair has a worker for each of its accounts.
+func (c *BankCase) writeSkew(ctx context.Context, db *sql.DB, pair, side int, rng *rand.Rand) {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopCh:
+			return
+		default:
+		}
+		if !c.waitResumed(ctx, nil) {
+			return
+		}
+		// only the retryable errors are retried, others are kept in withdrawErr
+		var withdrawErr error
+		err := RunWithRetry(ctx, c.cfg.RetryLimit, 10*time.Millisecond, func() error {
+			err := c.withdraw(ctx, db, pair, side, 1+rng.Intn(writeSkewBalance))
+			if IsRetryableTxnError(err) {
+				return err
+			}
+			withdrawErr = errors.Trace(err)
+			return nil
+		})
+		if err == nil {
+			err = withdrawErr
+		}
+		if err == nil {
+			err = c.checkWriteSkew(ctx, db, pair)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("[%s] write skew of pair %d error %v", c, pair, err)
+			if c.delay(ctx, writeSkewErrorInterval) != nil {
+				return
+			}
+		}
+	}
+}
+
+// withdraw withdraws amount from account side of pair if the pair has enough
+// money, otherwise it refills both accounts.
+func (c *BankCase) withdraw(ctx context.Context, db *sql.DB, pair, side, amount int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	var lock string
+	if c.cfg.WriteSkewLock {
+		lock = " " + lockClauses[c.cfg.LockMode]
+	}
+	var total int64
+	query := fmt.Sprintf("select ifnull(sum(balance), 0) from %s where id in (%d, %d)%s", c.writeSkewTable(), 2*pair, 2*pair+1, lock)
+	if err = tx.QueryRowContext(ctx, query).Scan(&total); err != nil {
+		return err
+	}
+	if total >= int64(amount) {
+		query = fmt.Sprintf("update %s set balance = balance - %d where id = %d", c.writeSkewTable(), amount, 2*pair+side)
+	} else {
+		query = fmt.Sprintf("update %s set balance = %d where id in (%d, %d)", c.writeSkewTable(), writeSkewBalance, 2*pair, 2*pair+1)
+	}
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkWriteSkew checks the total of pair isn't negative. It's a violation
+// if the withdrawals lock the accounts, otherwise it's only counted.
+func (c *BankCase) checkWriteSkew(ctx context.Context, db *sql.DB, pair int) error {
+	var total int64
+	query := fmt.Sprintf("select ifnull(sum(balance), 0) from %s where id in (%d, %d)", c.writeSkewTable(), 2*pair, 2*pair+1)
+	if err := db.QueryRowContext(ctx, query).Scan(&total); err != nil {
+		return errors.Trace(err)
+	}
+	if total >= 0 {
+		return nil
+	}
+	if c.cfg.WriteSkewLock {
+		c.stop(invariantViolation("write skew overdraws pair %d to %d though the withdrawals lock it", pair, total))
+		return nil
+	}
+	c.count(writeSkews, fmt.Sprintf("%d", pair))
+	log.Warnf("[%s] write skew overdraws pair %d to %d", c, pair, total)
+	return nil
+}